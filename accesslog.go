@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of the access log
+const (
+	accessCombined = "combined"
+	accessJSON     = "json"
+)
+
+// accessLog records the requests served by the proxy, in its own file.
+type accessLog struct {
+	format string
+	out    io.Writer
+}
+
+// openAccessLog opens the access log at path, which is reopened on SIGHUP.
+func openAccessLog(path, format string) (*accessLog, error) {
+	if format != accessCombined && format != accessJSON {
+		return nil, fmt.Errorf("unknown access log format %s, expected %s or %s", format, accessCombined, accessJSON)
+	}
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	onHangup(func() {
+		if err := f.Reopen(); err != nil {
+			log.Errorf("Could not reopen the access log %s: %s", path, err)
+		}
+	})
+	return &accessLog{format: format, out: f}, nil
+}
+
+// accessWriter follows a request through the proxy, counting what is sent
+// either way until it is done.
+type accessWriter struct {
+	http.ResponseWriter
+	log   *accessLog
+	start time.Time
+
+	// Taken before the request is rewritten for the backend
+	remote, method, uri, proto string
+	referer, userAgent, id     string
+
+	route, backend string
+	status         int
+	websocket      bool
+	// Only accessed atomically, websockets count from two goroutines
+	received, sent int64
+}
+
+// begin starts recording a request, returning nil if there is no access
+// log. The request's body is counted from now on.
+func (l *accessLog) begin(w http.ResponseWriter, r *http.Request) *accessWriter {
+	if l == nil {
+		return nil
+	}
+	a := &accessWriter{
+		ResponseWriter: w,
+		log:            l,
+		start:          time.Now(),
+		remote:         r.RemoteAddr,
+		method:         r.Method,
+		uri:            r.RequestURI,
+		proto:          r.Proto,
+		referer:        r.Referer(),
+		userAgent:      r.UserAgent(),
+		id:             r.Header.Get(requestIDHeader),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		a.remote = host
+	}
+	if r.Body != nil {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &a.received}
+	}
+	return a
+}
+
+// target records the route and backend a request went to.
+func (a *accessWriter) target(route *Route, backend string) {
+	if a != nil {
+		a.route, a.backend = route.ID, backend
+	}
+}
+
+func (a *accessWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	atomic.AddInt64(&a.sent, int64(n))
+	return n, err
+}
+
+// Flush lets responses be streamed.
+func (a *accessWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection for a websocket, still counting what
+// goes through it. The status is the one the backend answers the upgrade
+// with, which need not be 101.
+func (a *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T cannot be hijacked", a.ResponseWriter)
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	a.websocket = true
+	counted := bufio.NewReadWriter(
+		bufio.NewReader(&countingReader{ReadCloser: ioutil.NopCloser(bufrw.Reader), n: &a.received}),
+		bufio.NewWriter(&statusWriter{w: &countingWriter{w: bufrw.Writer, n: &a.sent}, status: &a.status}),
+	)
+	return conn, counted, nil
+}
+
+// statusWriter takes the status of a hijacked connection from the status
+// line at the start of what is written through it.
+type statusWriter struct {
+	w      io.Writer
+	status *int
+	line   []byte
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if *s.status == 0 {
+		s.line = append(s.line, p...)
+		if end := bytes.IndexByte(s.line, '\n'); end >= 0 || len(s.line) > 1024 {
+			*s.status = parseStatusLine(s.line)
+			s.line = nil
+		}
+	}
+	return s.w.Write(p)
+}
+
+// parseStatusLine returns the status of a response starting with a status
+// line such as "HTTP/1.1 101 Switching Protocols", or 502 if it does not.
+func parseStatusLine(line []byte) int {
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && strings.HasPrefix(fields[0], "HTTP/") {
+		if status, err := strconv.Atoi(fields[1]); err == nil {
+			return status
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// countingWriter counts the bytes written through it, flushing them on.
+type countingWriter struct {
+	w *bufio.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// finish writes the entry for a request, once it is done. For websockets
+// that is when the session closes.
+func (a *accessWriter) finish() {
+	if a == nil {
+		return
+	}
+	if a.status == 0 && a.websocket {
+		// The backend never answered the upgrade
+		a.status = http.StatusBadGateway
+	} else if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	var line string
+	if a.log.format == accessJSON {
+		line = a.json()
+	} else {
+		line = a.combined()
+	}
+	if _, err := io.WriteString(a.log.out, line+"\n"); err != nil {
+		log.Errorf("Could not write to the access log: %s", err)
+	}
+}
+
+// combined formats the entry in the Combined Log Format, followed by the
+// bytes received, the duration in seconds, the route and the backend.
+func (a *accessWriter) combined() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q %d %.3f %s %s",
+		a.remote, a.start.Format("02/Jan/2006:15:04:05 -0700"),
+		a.method, escapeLog(a.uri), a.proto, a.status, atomic.LoadInt64(&a.sent),
+		dash(a.referer), dash(a.userAgent),
+		atomic.LoadInt64(&a.received), time.Since(a.start).Seconds(), dash(a.route), dash(a.backend))
+}
+
+// escapeLog keeps a value from breaking a combined log line.
+func escapeLog(s string) string {
+	return strings.NewReplacer(`"`, `\"`, " ", "%20", "\n", `\n`).Replace(s)
+}
+
+func (a *accessWriter) json() string {
+	line, _ := json.Marshal(struct {
+		Time      string  `json:"time"`
+		Remote    string  `json:"remote"`
+		Method    string  `json:"method"`
+		Path      string  `json:"path"`
+		Proto     string  `json:"proto"`
+		Status    int     `json:"status"`
+		BytesIn   int64   `json:"bytes_in"`
+		BytesOut  int64   `json:"bytes_out"`
+		Duration  float64 `json:"duration"`
+		Route     string  `json:"route,omitempty"`
+		Backend   string  `json:"backend,omitempty"`
+		Websocket bool    `json:"websocket,omitempty"`
+		RequestID string  `json:"request_id,omitempty"`
+		Referer   string  `json:"referer,omitempty"`
+		UserAgent string  `json:"user_agent,omitempty"`
+	}{
+		a.start.UTC().Format("2006-01-02T15:04:05.000Z07:00"), a.remote, a.method, a.uri, a.proto, a.status,
+		atomic.LoadInt64(&a.received), atomic.LoadInt64(&a.sent), time.Since(a.start).Seconds(),
+		a.route, a.backend, a.websocket, a.id, a.referer, a.userAgent,
+	})
+	return string(line)
+}
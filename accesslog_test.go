@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accessLines receives the lines of an access log.
+type accessLines chan string
+
+func (l accessLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func (l accessLines) next(t *testing.T) string {
+	select {
+	case line := <-l:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing was written to the access log")
+		return ""
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(echoBackend)
+	defer backend.Close()
+	rm := &RouteMapping{AuthCookieName: "sid"}
+	rm.AddRoute("test", Route{FrontendPath: "/app", BackendAddr: backend.Listener.Addr().String(), AuthorizedCookie: "user"})
+	other := rm.AddRoute("test", Route{FrontendPath: "/other", BackendAddr: backend.Listener.Addr().String(), AuthorizedCookie: "s3cr3t"})
+	lines := make(accessLines, 10)
+	access := &accessLog{format: accessJSON, out: lines}
+	proxy := httptest.NewServer(&requestHandler{
+		Transport:    &http.Transport{},
+		RouteMapping: rm,
+		Frontend:     &frontend{Path: "/gxproxy", AccessLog: access},
+	})
+	defer proxy.Close()
+
+	var entry struct {
+		Method, Path, Route, Backend string
+		Status                       int
+		BytesIn                      int64 `json:"bytes_in"`
+		BytesOut                     int64 `json:"bytes_out"`
+		Websocket                    bool
+		RequestID                    string `json:"request_id"`
+	}
+	req, _ := http.NewRequest("POST", proxy.URL+"/gxproxy/other/notebook?page=2", strings.NewReader("hello"))
+	req.AddCookie(&http.Cookie{Name: "sid", Value: other.AuthorizedCookie})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	line := lines.next(t)
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != "POST" || entry.Path != "/gxproxy/other/notebook?page=2" || entry.Status != http.StatusOK ||
+		entry.BytesIn != 5 || entry.BytesOut != 2 || entry.Route != other.ID || entry.Backend != other.BackendAddr ||
+		entry.Websocket || entry.RequestID == "" {
+		t.Error("Logged", line)
+	}
+	if strings.Contains(line, other.AuthorizedCookie) {
+		t.Error("Cookie was logged", line)
+	}
+
+	// Websockets are logged once closed
+	checkBackend(t, proxy, "Backend")
+	lines.next(t)
+	line = lines.next(t)
+	entry.BytesOut = 0
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Websocket || entry.Status != http.StatusSwitchingProtocols || entry.BytesIn != 4 || entry.BytesOut <= 4 {
+		t.Error("Logged", line)
+	}
+
+	// Upgrades the backend refuses are logged with its answer
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no websockets here", http.StatusForbidden)
+	}))
+	defer refusing.Close()
+	rm.AddRoute("test", Route{FrontendPath: "/refusing", BackendAddr: refusing.Listener.Addr().String(), AuthorizedCookie: "user"})
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /gxproxy/refusing/ws HTTP/1.1\r\nHost: proxy\r\nCookie: sid=user\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	conn.Close()
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Fatal("Refused upgrade was answered with", res, err)
+	}
+	if err := json.Unmarshal([]byte(lines.next(t)), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Websocket || entry.Status != http.StatusForbidden {
+		t.Error("Refused upgrade was logged as", entry.Status)
+	}
+
+	access.format = accessCombined
+	res, err = http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	line = lines.next(t)
+	if !strings.Contains(line, `] "GET /gxproxy/missing HTTP/1.1" 400 `) || !strings.HasSuffix(line, " - -\n") {
+		t.Error("Logged", line)
+	}
+}
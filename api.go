@@ -2,58 +2,264 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Authnz
-	recvAPIKey := r.URL.Query().Get("api_key")
+	key := h.Frontend.APIKeys.Authenticate(requestAPIKey(r))
 	// If it doesn't match what we expect, kick
-	if recvAPIKey != h.Frontend.APIKey {
+	if key == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
 		http.Error(w, "Invalid API key", http.StatusUnauthorized)
 		return
 	}
-	log.Info("Received %s request to the API", r.Method)
+	if !key.HasScope(requiredScope(r)) {
+		http.Error(w, "API key lacks the required scope", http.StatusForbidden)
+		return
+	}
+	log.Infof("Received %s request to the API from key %s", r.Method, key.Name)
+	actor := apiActor(key)
+
+	switch {
+	case r.URL.Path == "/api":
+		h.serveLegacy(w, r, actor)
+	case r.URL.Path == "/api/routes" || r.URL.Path == "/api/routes/":
+		h.serveRoutes(w, r, actor)
+	case strings.HasPrefix(r.URL.Path, "/api/routes/"):
+		h.serveRoute(w, r, actor, r.URL.Path[len("/api/routes/"):])
+	case r.URL.Path == "/api/removals" && r.Method == "GET":
+		renderJSON(w, http.StatusOK, h.RouteMapping.Removals())
+	case r.URL.Path == "/api/audit" && r.Method == "GET":
+		h.serveAudit(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
 
+// serveLegacy handles the original /api endpoint, where a POST adds a route
+// and every response is the full route list.
+func (h *apiHandler) serveLegacy(w http.ResponseWriter, r *http.Request, actor string) {
 	// Request Processing
 	if r.Method == "GET" {
 		// Get a list of routes
 		renderViewData(h, w, r)
 	} else if r.Method == "POST" {
-		decoder := json.NewDecoder(r.Body)
-		route := new(Route)
-		err := decoder.Decode(&route)
+		route, ok := h.decodeRoute(w, r)
+		if !ok {
+			return
+		}
+		// Create a new route
+		h.RouteMapping.AddRoute(actor, route)
+
+		renderViewData(h, w, r)
+	} else {
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// serveRoutes handles the /api/routes collection.
+func (h *apiHandler) serveRoutes(w http.ResponseWriter, r *http.Request, actor string) {
+	switch r.Method {
+	case "GET":
+		renderViewData(h, w, r)
+	case "POST":
+		route, ok := h.decodeRoute(w, r)
+		if !ok {
+			return
+		}
+		added := h.RouteMapping.AddRoute(actor, route)
+		w.Header().Set("Location", "/api/routes/"+added.ID)
+		renderJSON(w, http.StatusCreated, added.snapshot())
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// serveRoute handles a single route at /api/routes/{id}.
+func (h *apiHandler) serveRoute(w http.ResponseWriter, r *http.Request, actor, id string) {
+	current, err := h.RouteMapping.GetRoute(id)
+	if err != nil {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		renderJSON(w, http.StatusOK, current.snapshot())
+	case "PUT":
+		route, ok := h.decodeRoute(w, r)
+		if !ok {
+			return
+		}
+		h.updateRoute(w, actor, id, route)
+	case "PATCH":
+		// Fields absent from the body keep their current value
+		route := current.snapshot()
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &route)
+		}
 		if err != nil {
-			log.Error(fmt.Sprintf("Error unmarshalling %s", err))
+			log.Errorf("Error unmarshalling %s", err)
 			http.Error(w, "Invalid Route Data", http.StatusBadRequest)
 			return
 		}
-
-		// Seems like this should automatically be a decode exception?
-		if route.FrontendPath == "" || route.BackendAddr == "" || route.AuthorizedCookie == "" {
-			log.Info("An invalid route was attempted [%s %s %s %s]", route.FrontendPath, route.BackendAddr, route.AuthorizedCookie, route.ContainerIds)
+		clearServerFields(&route)
+		if !h.validRoute(&route) {
 			http.Error(w, "Invalid Route Data", http.StatusBadRequest)
 			return
 		}
+		h.updateRoute(w, actor, id, route)
+	case "DELETE":
+		routeFields(current).request(r).Infof("Deleting route via the API")
+		h.RouteMapping.RemoveRoute(actor, current, "deleted through the API")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+	}
+}
 
-		// Create a new route
-		h.RouteMapping.AddRoute(
-			route.FrontendPath,
-			route.BackendAddr,
-			route.AuthorizedCookie,
-			route.ContainerIds,
-		)
+func (h *apiHandler) updateRoute(w http.ResponseWriter, actor, id string, route Route) {
+	updated, err := h.RouteMapping.UpdateRoute(actor, id, route)
+	switch err {
+	case nil:
+		renderJSON(w, http.StatusOK, updated.snapshot())
+	case errRouteNotFound:
+		http.Error(w, "Route not found", http.StatusNotFound)
+	case errRouteConflict:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-		renderViewData(h, w, r)
+// serveAudit lists the changes made to routes, optionally between the
+// RFC 3339 times given as since and until.
+func (h *apiHandler) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if h.RouteMapping.Audit == nil {
+		http.Error(w, "Audit log disabled", http.StatusNotFound)
+		return
 	}
+	var bounds [2]time.Time
+	for i, param := range []string{"since", "until"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid "+param+", expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		bounds[i] = t
+	}
+	records, err := h.RouteMapping.Audit.Records(bounds[0], bounds[1])
+	if err != nil {
+		log.Errorf("Could not read the audit log: %s", err)
+		http.Error(w, "Could not read the audit log", http.StatusInternalServerError)
+		return
+	}
+	renderJSON(w, http.StatusOK, records)
+}
+
+// decodeRoute reads a complete route definition from the request body,
+// replying with an error and returning false if it is not valid.
+func (h *apiHandler) decodeRoute(w http.ResponseWriter, r *http.Request) (Route, bool) {
+	decoder := json.NewDecoder(r.Body)
+	route := new(Route)
+	err := decoder.Decode(&route)
+	if err != nil {
+		log.Errorf("Error unmarshalling %s", err)
+		http.Error(w, "Invalid Route Data", http.StatusBadRequest)
+		return Route{}, false
+	}
+
+	clearServerFields(route)
+	if !h.validRoute(route) {
+		http.Error(w, "Invalid Route Data", http.StatusBadRequest)
+		return Route{}, false
+	}
+	return *route, true
+}
+
+// clearServerFields drops what a client sent for the fields of a route which
+// only the server maintains.
+func clearServerFields(route *Route) {
+	route.ID = ""
+	route.State = ""
+	route.LastSeen = time.Time{}
+}
+
+func (h *apiHandler) validRoute(route *Route) bool {
+	if route.Host != "" {
+		host, ok := normalizeHost(route.Host)
+		if !ok || !h.Frontend.allowedHost(host) {
+			log.Infof("A route with invalid host %q was attempted", route.Host)
+			return false
+		}
+		route.Host = host
+		// Host routes are served at the root of their host by default
+		if !strings.HasPrefix(route.FrontendPath, "/") {
+			route.FrontendPath = "/" + route.FrontendPath
+		}
+	}
+	// Seems like this should automatically be a decode exception?
+	if route.FrontendPath == "" || (route.BackendAddr == "" && len(route.Backends) == 0) || route.AuthorizedCookie == "" {
+		log.Infof("An invalid route was attempted [%s %s %s]", route.FrontendPath, route.BackendAddr, route.ContainerIds)
+		return false
+	}
+	for _, addr := range route.backendAddrs() {
+		if !validBackend(addr) {
+			log.Infof("A route with invalid backend %q was attempted", addr)
+			return false
+		}
+	}
+	if route.HealthPath != "" && !strings.HasPrefix(route.HealthPath, "/") {
+		log.Infof("A route with invalid health path %q was attempted", route.HealthPath)
+		return false
+	}
+	if _, err := route.BackendTLS.tlsConfig(); err != nil {
+		log.Infof("A route with unusable backend TLS settings was attempted: %s", err)
+		return false
+	}
+	if route.Teardown != nil && route.Teardown.GracePeriod < 0 {
+		log.Infof("A route with negative teardown grace period %d was attempted", route.Teardown.GracePeriod)
+		return false
+	}
+	if !balancePolicies[route.Balance] {
+		log.Infof("A route with unknown balance policy %s was attempted", route.Balance)
+		return false
+	}
+	if !validRewrite(route.Rewrite) {
+		return false
+	}
+	if !h.RouteMapping.HasRuntime(route.Runtime) {
+		log.Infof("A route with unknown runtime %s was attempted", route.Runtime)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
 func renderViewData(h *apiHandler, w http.ResponseWriter, r *http.Request) {
-	jsonRoutes, err := json.MarshalIndent(h.RouteMapping.Routes, "", "    ")
+	renderJSON(w, http.StatusOK, h.RouteMapping.Snapshot())
+}
+
+func renderJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "    ")
 	if err != nil {
 		http.Error(w, "Data encoding error", http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, string(jsonRoutes))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
 }
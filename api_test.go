@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,6 +28,21 @@ func get(ts *httptest.Server, path string) (string, int, error) {
 	return string(data), res.StatusCode, nil
 }
 
+// writeTempFile writes data to a new temporary file, removed when the test
+// ends, and returns its path.
+func writeTempFile(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
 type testcase struct {
 	Path         string
 	Body         []byte
@@ -35,7 +52,11 @@ type testcase struct {
 }
 
 func post(ts *httptest.Server, path string, jsonStr []byte) (string, int, error) {
-	req, err := http.NewRequest("POST", ts.URL+path, bytes.NewBuffer(jsonStr))
+	return do(ts, "POST", path, jsonStr)
+}
+
+func do(ts *httptest.Server, method string, path string, jsonStr []byte) (string, int, error) {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewBuffer(jsonStr))
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
@@ -68,9 +89,9 @@ func apiTest(data string, code int, err error, tc testcase, t *testing.T) {
 
 func TestApiServeHTTP_get(t *testing.T) {
 	frontend := &frontend{
-		Addr:   "127.0.0.1",
-		Path:   "/gxproxy",
-		APIKey: "supersecret",
+		Addr:    "127.0.0.1",
+		Path:    "/gxproxy",
+		APIKeys: testKeyring(),
 	}
 	var tsh = &apiHandler{
 		Transport: &http.Transport{
@@ -79,8 +100,6 @@ func TestApiServeHTTP_get(t *testing.T) {
 		},
 		RouteMapping: &RouteMapping{
 			AuthCookieName: "sid",
-			Routes:         make([]Route, 0),
-			Storage:        "/dev/null",
 		},
 		Frontend: frontend,
 	}
@@ -99,7 +118,7 @@ func TestApiServeHTTP_get(t *testing.T) {
 		apiTest(data, code, err, tc, t)
 	}
 
-	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.Local)
 	route := &Route{
 		FrontendPath:     "/some/path",
 		BackendAddr:      "1.1.1.1",
@@ -112,15 +131,12 @@ func TestApiServeHTTP_get(t *testing.T) {
 	if err != nil {
 		t.Error("Could not serialize test case route", err)
 	}
-	tcDataRoutes, err := json.MarshalIndent(routes, "", "    ")
-	if err != nil {
-		t.Error("Could not serialize test case route", err)
-	}
 
 	tests2 := []testcase{
 		{"/api?api_key=supersecret", nil, 400, "Invalid Route Data\n", nil},
 		{"/api?api_key=supersecret", []byte("asdf"), 400, "Invalid Route Data\n", nil},
 		{"/api?api_key=supersecret", []byte("{\"FrontendPath\": \"\"}"), 400, "Invalid Route Data\n", nil},
+		{"/api?api_key=supersecret", []byte(`{"FrontendPath": "/x", "BackendAddr": "127.0.0.1:80", "AuthorizedCookie": "c", "HealthPath": "@evil:80/x"}`), 400, "Invalid Route Data\n", nil},
 	}
 
 	for _, tc := range tests2 {
@@ -129,16 +145,109 @@ func TestApiServeHTTP_get(t *testing.T) {
 	}
 
 	tests3 := []testcase{
-		{"/api?api_key=supersecret", tcDataRoute, 200, string(tcDataRoutes), nil},
+		{"/api?api_key=supersecret", tcDataRoute, 200, "", nil},
 	}
 	for _, tc := range tests3 {
 		_, code, err := post(ts, tc.Path, tc.Body)
-		if len(tsh.RouteMapping.Routes) > 0 {
-			for idx := range tsh.RouteMapping.Routes {
-				tsh.RouteMapping.Routes[idx].LastSeen = now
-			}
+		tsh.RouteMapping.mu.RLock()
+		for idx, route := range tsh.RouteMapping.routes {
+			atomic.StoreInt64(&route.live.seen, now.UnixNano())
+			// IDs and states are maintained by the server
+			routes[idx].ID = route.ID
+			routes[idx].State = routeReady
+		}
+		tsh.RouteMapping.mu.RUnlock()
+		tcDataRoutes, err := json.MarshalIndent(routes, "", "    ")
+		if err != nil {
+			t.Error("Could not serialize test case route", err)
 		}
+		tc.ExpectedMsg = string(tcDataRoutes)
 		data, code, err := get(ts, tc.Path)
 		apiTest(data, code, err, tc, t)
 	}
 }
+
+func TestApiServeHTTP_routes(t *testing.T) {
+	rm := &RouteMapping{
+		AuthCookieName: "sid",
+	}
+	ts := httptest.NewServer(&apiHandler{
+		RouteMapping: rm,
+		Frontend:     &frontend{APIKeys: testKeyring()},
+	})
+	defer ts.Close()
+
+	decode := func(data string) Route {
+		route := Route{}
+		if err := json.Unmarshal([]byte(data), &route); err != nil {
+			t.Fatal("Could not decode", data, err)
+		}
+		return route
+	}
+
+	data, code, err := post(ts, "/api/routes?api_key=supersecret", []byte(`{"ID": "mine", "FrontendPath": "/ipython/1", "BackendAddr": "1.1.1.1:8888", "AuthorizedCookie": "gxsesh"}`))
+	if err != nil || code != 201 {
+		t.Fatal("Creating route returned", code, data, err)
+	}
+	created := decode(data)
+	if created.ID == "" || created.ID == "mine" {
+		t.Error("Route ID was not assigned by the server:", created.ID)
+	}
+	_, _, _ = post(ts, "/api/routes?api_key=supersecret", []byte(`{"FrontendPath": "/ipython/2", "BackendAddr": "2.2.2.2:8888", "AuthorizedCookie": "gxsesh"}`))
+	path := "/api/routes/" + created.ID + "?api_key=supersecret"
+
+	data, code, err = get(ts, path)
+	if err != nil || code != 200 || decode(data).BackendAddr != "1.1.1.1:8888" {
+		t.Error("Fetching route returned", code, data, err)
+	}
+
+	// Fields maintained by the server are not taken from the client
+	data, code, err = do(ts, "PATCH", path, []byte(`{"BackendAddr": "3.3.3.3:8888", "ID": "mine", "State": "pending", "LastSeen": "2001-01-01T00:00:00Z"}`))
+	if err != nil || code != 200 {
+		t.Error("Patching route returned", code, data, err)
+	}
+	if patched := decode(data); patched.BackendAddr != "3.3.3.3:8888" || patched.FrontendPath != "/ipython/1" || patched.ID != created.ID {
+		t.Error("Patch did not merge into existing route", patched)
+	} else if patched.State != routeReady || patched.LastSeen.Year() == 2001 {
+		t.Error("Patch changed the state of the route", patched)
+	}
+
+	data, code, err = do(ts, "PUT", path, []byte(`{"FrontendPath": "/ipython/3", "BackendAddr": "4.4.4.4:8888", "AuthorizedCookie": "gxsesh"}`))
+	if err != nil || code != 200 || decode(data).ID != created.ID {
+		t.Error("Replacing route returned", code, data, err)
+	}
+	if route, err := rm.FindRoute("/ipython/3/tree", "gxsesh"); err != nil || route.ID != created.ID {
+		t.Error("Replaced route is not reachable at its new path")
+	}
+	if _, err := rm.FindRoute("/ipython/1/tree", "gxsesh"); err == nil {
+		t.Error("Replaced route is still reachable at its old path")
+	}
+
+	tests := []struct {
+		Method       string
+		Path         string
+		Body         string
+		ExpectedCode int
+	}{
+		{"PUT", path, `{"FrontendPath": "/ipython/2", "BackendAddr": "4.4.4.4:8888", "AuthorizedCookie": "gxsesh"}`, 409},
+		{"PUT", path, `{"FrontendPath": "/ipython/3"}`, 400},
+		{"PATCH", path, `{"BackendAddr": ""}`, 400},
+		{"PATCH", path, `{"Teardown": {"GracePeriod": -1}}`, 400},
+		{"POST", path, ``, 405},
+		{"GET", "/api/routes/unknown?api_key=supersecret", ``, 404},
+		{"DELETE", "/api/routes/unknown?api_key=supersecret", ``, 404},
+		{"GET", "/api/unknown?api_key=supersecret", ``, 404},
+		{"DELETE", path, ``, 204},
+		{"GET", path, ``, 404},
+	}
+	for _, tc := range tests {
+		data, code, err := do(ts, tc.Method, tc.Path, []byte(tc.Body))
+		if err != nil || code != tc.ExpectedCode {
+			t.Error(tc.Method, tc.Path, "had code", code, data, err, "expected code", tc.ExpectedCode)
+		}
+	}
+
+	if rm.Len() != 1 {
+		t.Error("Expected only one route to remain, found", rm.Len())
+	}
+}
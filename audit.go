@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Who changes routes, besides API keys
+const (
+	actorCleaner     = "cleaner"
+	actorDeadBackend = "dead-backend"
+	actorEvents      = "container-events"
+	actorStartup     = "startup-probe"
+)
+
+// Changes made to routes
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// maxAuditRecords is how many records are remembered without an audit file.
+const maxAuditRecords = 1000
+
+// apiActor names the changes made with an API key.
+func apiActor(key *apiKey) string {
+	return "api:" + key.Name
+}
+
+// AuditRecord is a change to a route: who made it, why, and the route
+// before and after it. The cookies of the routes are left out.
+type AuditRecord struct {
+	Time    time.Time
+	Action  string
+	Actor   string
+	Reason  string `json:",omitempty"`
+	RouteID string
+	Before  *Route `json:",omitempty"`
+	After   *Route `json:",omitempty"`
+}
+
+// auditLog keeps the records of every change to the routes. With a path
+// they are appended to that file, one JSON object per line, and never
+// rewritten; without, only the latest are kept in memory.
+type auditLog struct {
+	path string
+
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+// auditSnapshot is the state of a route as recorded in the audit log.
+func auditSnapshot(route *Route) *Route {
+	if route == nil {
+		return nil
+	}
+	snapshot := route.snapshot()
+	snapshot.AuthorizedCookie = ""
+	return &snapshot
+}
+
+// record adds a change to the log. Either route may be nil, for routes
+// being created or deleted.
+func (a *auditLog) record(action, actor, reason string, before, after *Route) {
+	if a == nil {
+		return
+	}
+	rec := AuditRecord{
+		Time:   time.Now(),
+		Action: action,
+		Actor:  actor,
+		Reason: reason,
+		Before: auditSnapshot(before),
+		After:  auditSnapshot(after),
+	}
+	if after != nil {
+		rec.RouteID = after.ID
+	} else if before != nil {
+		rec.RouteID = before.ID
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		a.records = append(a.records, rec)
+		if len(a.records) > maxAuditRecords {
+			a.records = a.records[len(a.records)-maxAuditRecords:]
+		}
+		return
+	}
+	if err := a.appendLocked(rec); err != nil {
+		log.Errorf("Could not write to the audit log %s: %s", a.path, err)
+	}
+}
+
+// appendLocked writes a record at the end of the audit file. The file is
+// opened for each record, so it can be moved away at any time.
+func (a *auditLog) appendLocked(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records returns the records made from since until before until, oldest
+// first. Zero times leave the range open.
+func (a *auditLog) Records(since, until time.Time) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+	keep := func(rec AuditRecord) {
+		if (since.IsZero() || !rec.Time.Before(since)) && (until.IsZero() || rec.Time.Before(until)) {
+			records = append(records, rec)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		for _, rec := range a.records {
+			keep(rec)
+		}
+		return records, nil
+	}
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// Routes with many containers make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A line cut short by a crash
+			continue
+		}
+		keep(rec)
+	}
+	return records, scanner.Err()
+}
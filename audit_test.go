@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	rm := &RouteMapping{Audit: newAuditLog(path)}
+	ts := httptest.NewServer(&apiHandler{RouteMapping: rm, Frontend: &frontend{APIKeys: testKeyring()}})
+	defer ts.Close()
+
+	start := time.Now()
+	data, code, err := post(ts, "/api/routes?api_key=supersecret", []byte(`{"FrontendPath": "/a", "BackendAddr": "a:80", "AuthorizedCookie": "s3cr3t"}`))
+	if err != nil || code != 201 {
+		t.Fatal("Creating route returned", code, data, err)
+	}
+	var added Route
+	json.Unmarshal([]byte(data), &added)
+	data, code, err = do(ts, "PATCH", "/api/routes/"+added.ID+"?api_key=supersecret", []byte(`{"BackendAddr": "b:80"}`))
+	if err != nil || code != 200 {
+		t.Fatal("Updating route returned", code, data, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	rm.RemoveRoute(actorCleaner, &added, "no access for 1h0m0s")
+
+	var records []AuditRecord
+	list := func(query string) {
+		data, code, err := get(ts, "/api/audit?api_key=supersecret"+query)
+		if err != nil || code != 200 {
+			t.Fatal("Listing the audit log returned", code, data, err)
+		}
+		records = nil
+		if err := json.Unmarshal([]byte(data), &records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list("")
+	if len(records) != 3 {
+		t.Fatal("Expected 3 records, found", records)
+	}
+	create, update, remove := records[0], records[1], records[2]
+	if create.Action != auditCreate || create.Actor != "api:default" || create.RouteID != added.ID ||
+		create.Before != nil || create.After == nil || create.After.BackendAddr != "a:80" || create.Time.Before(start) {
+		t.Errorf("Creation recorded as %+v", create)
+	}
+	if update.Action != auditUpdate || update.Actor != "api:default" ||
+		update.Before == nil || update.Before.BackendAddr != "a:80" || update.After == nil || update.After.BackendAddr != "b:80" {
+		t.Errorf("Update recorded as %+v", update)
+	}
+	if remove.Action != auditDelete || remove.Actor != actorCleaner || remove.Reason != "no access for 1h0m0s" ||
+		remove.Before == nil || remove.Before.BackendAddr != "b:80" || remove.After != nil {
+		t.Errorf("Removal recorded as %+v", remove)
+	}
+
+	list("&since=" + url.QueryEscape(middle.Format(time.RFC3339Nano)))
+	if len(records) != 1 || records[0].Action != auditDelete {
+		t.Error("Expected the removal since", middle, "found", records)
+	}
+	list("&until=" + url.QueryEscape(middle.Format(time.RFC3339Nano)))
+	if len(records) != 2 {
+		t.Error("Expected the creation and update until", middle, "found", records)
+	}
+	if _, code, _ := get(ts, "/api/audit?api_key=supersecret&since=yesterday"); code != 400 {
+		t.Error("Invalid time answered", code)
+	}
+
+	// The file is only ever appended to, and holds no cookies
+	file, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(file), "\n"); lines != 3 {
+		t.Error("Expected 3 lines in the audit log, found", lines)
+	}
+	if strings.Contains(string(file), "s3cr3t") {
+		t.Error("Audit log holds the route's cookie")
+	}
+	// Broken lines are skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("{\"Time\": \"20\n")
+	f.Close()
+	rm.Audit.record(auditCreate, actorCleaner, "", nil, &added)
+	if records, err := rm.Audit.Records(time.Time{}, time.Time{}); err != nil || len(records) != 4 {
+		t.Error("Expected to skip the broken line, found", len(records), err)
+	}
+}
+
+func TestAuditLogInMemory(t *testing.T) {
+	audit := newAuditLog("")
+	route := &Route{ID: "a", FrontendPath: "/a", AuthorizedCookie: "s3cr3t"}
+	for i := 0; i < maxAuditRecords+10; i++ {
+		audit.record(auditUpdate, "test", "", route, route)
+	}
+	records, err := audit.Records(time.Time{}, time.Time{})
+	if err != nil || len(records) != maxAuditRecords {
+		t.Error("Expected", maxAuditRecords, "records, found", len(records), err)
+	}
+	if records[0].After.AuthorizedCookie != "" || route.AuthorizedCookie != "s3cr3t" {
+		t.Error("Cookie was recorded, or taken from the route")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// API key scopes
+const (
+	// scopeRead allows listing and fetching routes
+	scopeRead = "read"
+	// scopeWrite allows adding, changing and removing routes
+	scopeWrite = "write"
+)
+
+var knownScopes = map[string]bool{scopeRead: true, scopeWrite: true}
+
+// apiKey is a named credential for the API along with the scopes it grants.
+type apiKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasScope checks whether the key grants a scope.
+func (k *apiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyring is the set of keys accepted by the API. Keys loaded from a file
+// can be reloaded at runtime, so one key can be rotated while another one
+// stays valid.
+type apiKeyring struct {
+	mu   sync.RWMutex
+	path string
+	// fixed keys come from the command line, loaded ones from path.
+	fixed  []apiKey
+	loaded []apiKey
+}
+
+// newAPIKeyring builds a keyring from the keys file at path (if any) plus an
+// optional single key which is granted every scope.
+func newAPIKeyring(path string, defaultKey string) (*apiKeyring, error) {
+	k := &apiKeyring{path: path}
+	if defaultKey != "" {
+		k.fixed = append(k.fixed, apiKey{
+			Name:   "default",
+			Key:    defaultKey,
+			Scopes: []string{scopeRead, scopeWrite},
+		})
+	}
+	if path != "" {
+		if err := k.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Reload re-reads the keys file, replacing every key previously loaded from
+// it. On error the current keys are kept.
+func (k *apiKeyring) Reload() error {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parsing API keys file %s: %s", k.path, err)
+	}
+
+	names := make(map[string]bool)
+	for _, key := range k.fixed {
+		names[key.Name] = true
+	}
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return errors.New("API keys must have a name and a key")
+		}
+		if names[key.Name] {
+			return fmt.Errorf("API key name %s is used more than once", key.Name)
+		}
+		names[key.Name] = true
+		for _, scope := range key.Scopes {
+			if !knownScopes[scope] {
+				return fmt.Errorf("API key %s has unknown scope %s", key.Name, scope)
+			}
+		}
+	}
+	k.mu.Lock()
+	k.loaded = keys
+	k.mu.Unlock()
+	log.Infof("Loaded %d API keys from %s", len(keys), k.path)
+	return nil
+}
+
+// Authenticate returns the key matching secret, or nil. Every key is
+// compared, in constant time, so timing reveals neither which key matched nor
+// how much of it did.
+func (k *apiKeyring) Authenticate(secret string) *apiKey {
+	if secret == "" {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(secret))
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var match *apiKey
+	for _, keys := range [][]apiKey{k.fixed, k.loaded} {
+		for idx := range keys {
+			keyDigest := sha256.Sum256([]byte(keys[idx].Key))
+			if subtle.ConstantTimeCompare(digest[:], keyDigest[:]) == 1 {
+				key := keys[idx]
+				match = &key
+			}
+		}
+	}
+	return match
+}
+
+// requestAPIKey extracts the API key from a request, preferring the
+// Authorization header. The api_key query parameter is still accepted for
+// older clients but ends up in access logs, so should be avoided.
+func requestAPIKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// requiredScope returns the scope a request needs.
+func requiredScope(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return scopeRead
+	}
+	return scopeWrite
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKeyring returns a keyring accepting "supersecret" with every scope.
+func testKeyring() *apiKeyring {
+	keys, err := newAPIKeyring("", "supersecret")
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func TestApiKeyringReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[
+		{"name": "galaxy", "key": "old", "scopes": ["read", "write"]},
+		{"name": "monitoring", "key": "peek", "scopes": ["read"]}
+	]`)
+	keys, err := newAPIKeyring(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keys.Authenticate("old"); key == nil || key.Name != "galaxy" {
+		t.Error("Expected old key to authenticate as galaxy, found", key)
+	}
+	if key := keys.Authenticate("THE_DEFAULT_IS_NOT_SECURE"); key != nil {
+		t.Error("Unexpected key accepted", key)
+	}
+
+	// Rotate the galaxy key, keeping the old one valid until Galaxy is
+	// restarted with the new one.
+	write(`[
+		{"name": "galaxy", "key": "new", "scopes": ["read", "write"]},
+		{"name": "galaxy-old", "key": "old", "scopes": ["read", "write"]}
+	]`)
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"new", "old"} {
+		if keys.Authenticate(secret) == nil {
+			t.Error("Expected", secret, "to be accepted after rotation")
+		}
+	}
+	if keys.Authenticate("peek") != nil {
+		t.Error("Removed key was still accepted")
+	}
+
+	invalid := []string{
+		`not json`,
+		`[{"name": "", "key": "x"}]`,
+		`[{"name": "a", "key": "x"}, {"name": "a", "key": "y"}]`,
+		`[{"name": "a", "key": "x", "scopes": ["admin"]}]`,
+	}
+	for _, data := range invalid {
+		write(data)
+		if err := keys.Reload(); err == nil {
+			t.Error("Expected error loading", data)
+		}
+		if keys.Authenticate("new") == nil {
+			t.Error("A failed reload dropped the existing keys")
+		}
+	}
+}
+
+func TestApiServeHTTP_auth(t *testing.T) {
+	keys := testKeyring()
+	keys.loaded = []apiKey{{Name: "monitoring", Key: "peek", Scopes: []string{scopeRead}}}
+	ts := httptest.NewServer(&apiHandler{
+		RouteMapping: &RouteMapping{},
+		Frontend:     &frontend{APIKeys: keys},
+	})
+	defer ts.Close()
+
+	route := `{"FrontendPath": "/ipython/1", "BackendAddr": "1.1.1.1:8888", "AuthorizedCookie": "gxsesh"}`
+	tests := []struct {
+		Method        string
+		Path          string
+		Authorization string
+		ExpectedCode  int
+	}{
+		{"GET", "/api/routes", "", 401},
+		{"GET", "/api/routes", "Bearer wrong", 401},
+		{"GET", "/api/routes", "Basic c3VwZXJzZWNyZXQ=", 401},
+		{"GET", "/api/routes", "Bearer supersecret", 200},
+		{"GET", "/api/routes", "bearer supersecret", 200},
+		{"GET", "/api/routes?api_key=supersecret", "", 200},
+		{"GET", "/api/routes", "Bearer peek", 200},
+		{"POST", "/api/routes", "Bearer peek", 403},
+		{"POST", "/api/routes", "Bearer supersecret", 201},
+	}
+	for _, tc := range tests {
+		body := ""
+		if tc.Method == "POST" {
+			body = route
+		}
+		req, err := http.NewRequest(tc.Method, ts.URL+tc.Path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.Authorization != "" {
+			req.Header.Set("Authorization", tc.Authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.ExpectedCode {
+			t.Error(tc.Method, tc.Path, tc.Authorization, "had code", res.StatusCode, "expected code", tc.ExpectedCode)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Prefixes of backend addresses which are not plain host:port HTTP servers
+const (
+	// backendHTTPS backends are spoken to over TLS.
+	backendHTTPS = "https://"
+	// backendUnix backends listen on a unix socket, often in a volume
+	// shared with their container.
+	backendUnix = "unix://"
+)
+
+// BackendTLS is how the https:// backends of a route are verified.
+type BackendTLS struct {
+	// CA is a PEM bundle of the CAs to trust instead of the system's. It is
+	// given inline, routes do not get to read files of the proxy.
+	CA string `xml:",omitempty" json:",omitempty"`
+	// ServerName is the name to verify instead of the backend's host.
+	ServerName string `xml:",omitempty" json:",omitempty"`
+	// Insecure accepts any certificate.
+	Insecure bool `xml:",omitempty" json:",omitempty"`
+}
+
+// backendTarget is where a backend address points.
+type backendTarget struct {
+	// scheme is http or https.
+	scheme string
+	// host is put in request URLs. For unix sockets it only names the
+	// socket, which is dialed instead.
+	host string
+	// socket is the path of a unix socket.
+	socket string
+}
+
+// parseBackend splits a backend address, which is host:port, https://host:port
+// or unix:///path/to.sock.
+func parseBackend(addr string) backendTarget {
+	switch {
+	case strings.HasPrefix(addr, backendHTTPS):
+		return backendTarget{scheme: "https", host: strings.TrimSuffix(addr[len(backendHTTPS):], "/")}
+	case strings.HasPrefix(addr, backendUnix):
+		return backendTarget{scheme: "http", host: "unix", socket: addr[len(backendUnix):]}
+	}
+	return backendTarget{scheme: "http", host: addr}
+}
+
+// validBackend checks that a backend address can be dialed.
+func validBackend(addr string) bool {
+	target := parseBackend(addr)
+	if target.socket != "" {
+		return strings.HasPrefix(target.socket, "/")
+	}
+	return target.host != "" && !strings.ContainsAny(target.host, "/?#")
+}
+
+// tlsConfig builds the TLS configuration for a route's https:// backends.
+func (c *BackendTLS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c == nil {
+		return config, nil
+	}
+	config.ServerName = c.ServerName
+	config.InsecureSkipVerify = c.Insecure
+	if c.CA != "" {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(c.CA)) {
+			return nil, errors.New("no certificates found in the CA")
+		}
+	}
+	return config, nil
+}
+
+// newBackendTransport derives a transport for a backend from base, which is
+// used as is for plain HTTP ones.
+func newBackendTransport(base *http.Transport, target backendTarget, c *BackendTLS) (*http.Transport, error) {
+	if target.scheme == "http" && target.socket == "" {
+		return base, nil
+	}
+	t := base.Clone()
+	if target.socket != "" {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, "unix", target.socket)
+		}
+	}
+	if target.scheme == "https" {
+		config, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = config
+	}
+	t.IdleConnTimeout = 90 * time.Second
+	return t, nil
+}
+
+// transportFor returns the transport for requests to a backend of a route,
+// creating it the first time, or again if the route's TLS settings changed.
+func (b *backendState) transportFor(base *http.Transport, target backendTarget, c *BackendTLS) (*http.Transport, error) {
+	key := fmt.Sprintf("%+v", c)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.transport != nil && b.transportKey == key {
+		return b.transport, nil
+	}
+	t, err := newBackendTransport(base, target, c)
+	if err != nil {
+		return nil, err
+	}
+	if b.transport != nil && b.transport != base {
+		b.transport.CloseIdleConnections()
+	}
+	b.transport, b.transportKey = t, key
+	return t, nil
+}
+
+// backendTransport points a request at a backend of its route, and returns
+// the transport to send it with.
+func (h *requestHandler) backendTransport(route *Route, addr string, r *http.Request) (*http.Transport, error) {
+	base := h.Transport
+	if base == nil {
+		base = &http.Transport{}
+	}
+	target := parseBackend(addr)
+	t, err := route.live.backends.get(addr).transportFor(base, target, route.BackendTLS)
+	if err != nil {
+		return nil, err
+	}
+	r.URL.Scheme, r.URL.Host = target.scheme, target.host
+	return t, nil
+}
+
+// dialBackend opens a connection to the backend a request points at, the
+// way transport would, for requests it cannot carry such as websockets.
+func dialBackend(ctx context.Context, t *http.Transport, u *url.URL) (net.Conn, error) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", u.Host)
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+	config := t.TLSClientConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	timeout := t.TLSHandshakeTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		Addr                 string
+		Scheme, Host, Socket string
+		Valid                bool
+	}{
+		{"127.0.0.1:8888", "http", "127.0.0.1:8888", "", true},
+		{"https://ie.internal:8443", "https", "ie.internal:8443", "", true},
+		{"https://ie.internal:8443/", "https", "ie.internal:8443", "", true},
+		{"unix:///srv/ie/http.sock", "http", "unix", "/srv/ie/http.sock", true},
+		{"unix://http.sock", "http", "unix", "http.sock", false},
+		{"https://", "https", "", "", false},
+		{"", "http", "", "", false},
+		{"ie.internal/path", "http", "ie.internal/path", "", false},
+	}
+	for _, tc := range tests {
+		target := parseBackend(tc.Addr)
+		if target.scheme != tc.Scheme || target.host != tc.Host || target.socket != tc.Socket {
+			t.Errorf("%s parsed as %+v", tc.Addr, target)
+		}
+		if validBackend(tc.Addr) != tc.Valid {
+			t.Errorf("%s valid: %v", tc.Addr, !tc.Valid)
+		}
+	}
+}
+
+// echoBackend answers HTTP requests with "ok", and echoes whatever is sent
+// over upgraded connections.
+var echoBackend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !shouldUpgradeWebsocket(r) {
+		w.Write([]byte("ok"))
+		return
+	}
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	bufrw.Flush()
+	io.Copy(conn, bufrw)
+})
+
+// checkBackend makes a plain and a websocket request to the route through
+// the proxy.
+func checkBackend(t *testing.T, proxy *httptest.Server, what string) {
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Error(what, "answered", res.StatusCode, string(body))
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /gxproxy/app/ws HTTP/1.1\r\nHost: proxy\r\nCookie: sid=user\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(what, "did not upgrade the websocket", err)
+	}
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+		t.Error(what, "websocket echoed", string(echo), err)
+	}
+}
+
+func TestBackendKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A unix socket
+	socket := filepath.Join(dir, "http.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: echoBackend}
+	go server.Serve(l)
+	defer server.Close()
+
+	proxy, rm, route := proxyTest(t, http.NotFoundHandler())
+	rm.Failures.Removal = removeNever
+	update := func(route Route) {
+		if _, err := rm.UpdateRoute("test", route.ID, route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unix := route.snapshot()
+	unix.BackendAddr = backendUnix + socket
+	update(unix)
+	checkBackend(t, proxy, "Unix socket backend")
+	if err := probeBackend(unix.BackendAddr, nil, "", time.Second); err != nil {
+		t.Error("Unix socket failed the probe", err)
+	}
+
+	// HTTPS with a CA of its own
+	backend := httptest.NewTLSServer(echoBackend)
+	defer backend.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	secure := route.snapshot()
+	secure.BackendAddr = backendHTTPS + backend.Listener.Addr().String()
+	secure.BackendTLS = &BackendTLS{CA: string(ca), ServerName: "example.com"}
+	update(secure)
+	checkBackend(t, proxy, "HTTPS backend")
+	if err := probeBackend(secure.BackendAddr, secure.BackendTLS, "/health", time.Second); err != nil {
+		t.Error("HTTPS backend failed the probe", err)
+	}
+
+	// Its certificate is checked, unless told not to
+	secure.BackendTLS = nil
+	update(secure)
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		t.Error("Untrusted backend certificate was accepted")
+	}
+	secure.BackendTLS = &BackendTLS{Insecure: true}
+	update(secure)
+	checkBackend(t, proxy, "Unverified HTTPS backend")
+
+	if _, err := (&BackendTLS{CA: "/etc/ssl/certs/ca-certificates.crt"}).tlsConfig(); err == nil {
+		t.Error("CA without certificates was accepted")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ways of spreading requests over the backends of a route
+const (
+	// balanceRoundRobin sends each request to the next backend in turn.
+	balanceRoundRobin = "round-robin"
+	// balanceLeastConn sends each request to the backend with the fewest
+	// requests and websockets in flight.
+	balanceLeastConn = "least-conn"
+	// balanceCookieHash always sends a user to the same backend, as long
+	// as it is healthy.
+	balanceCookieHash = "cookie-hash"
+)
+
+var balancePolicies = map[string]bool{"": true, balanceRoundRobin: true, balanceLeastConn: true, balanceCookieHash: true}
+
+// backendState is what is known about one backend of a route.
+type backendState struct {
+	// active requests and websockets, only accessed atomically.
+	active  int64
+	breaker breakerState
+
+	// mu guards the transport requests are sent with, which is built for
+	// the route's TLS settings as of transportKey.
+	mu           sync.Mutex
+	transport    *http.Transport
+	transportKey string
+}
+
+// backendPool holds the state of the backends of a route, by address.
+type backendPool struct {
+	mu       sync.Mutex
+	backends map[string]*backendState
+	// next is the round-robin counter, only accessed atomically.
+	next uint32
+}
+
+// get returns the state of a backend, creating it on first use.
+func (p *backendPool) get(addr string) *backendState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.backends == nil {
+		p.backends = make(map[string]*backendState)
+	}
+	b, ok := p.backends[addr]
+	if !ok {
+		b = &backendState{}
+		p.backends[addr] = b
+	}
+	return b
+}
+
+// backendAddrs returns the addresses of the route's backends. Backends, if
+// given, takes precedence over BackendAddr.
+func (r *Route) backendAddrs() []string {
+	if len(r.Backends) > 0 {
+		return r.Backends
+	}
+	return []string{r.BackendAddr}
+}
+
+// healthyBackends returns the backends of the route whose circuit is closed.
+func (r *Route) healthyBackends(now time.Time) []string {
+	addrs := r.backendAddrs()
+	healthy := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if r.live.backends.get(addr).breaker.allow(now) {
+			healthy = append(healthy, addr)
+		}
+	}
+	return healthy
+}
+
+// pickBackend chooses the backend for a request according to the route's
+// Balance policy, skipping backends whose circuit is open unless all of them
+// are. Websockets are always placed by cookie, so that a user reconnecting
+// finds the same backend, and stay on it for as long as they are open. The
+// returned function must be called once the request is done.
+func (rm *RouteMapping) pickBackend(route *Route, cookie string, websocket bool) (string, func()) {
+	pool := &route.live.backends
+	healthy := route.healthyBackends(time.Now())
+	if len(healthy) == 0 {
+		healthy = route.backendAddrs()
+	}
+
+	policy := route.Balance
+	if websocket {
+		policy = balanceCookieHash
+	}
+	var addr string
+	switch {
+	case len(healthy) == 1:
+		addr = healthy[0]
+	case policy == balanceLeastConn:
+		addr = healthy[0]
+		least := atomic.LoadInt64(&pool.get(addr).active)
+		for _, candidate := range healthy[1:] {
+			if active := atomic.LoadInt64(&pool.get(candidate).active); active < least {
+				addr, least = candidate, active
+			}
+		}
+	case policy == balanceCookieHash:
+		addr = rendezvous(healthy, cookie)
+	default:
+		n := atomic.AddUint32(&pool.next, 1) - 1
+		addr = healthy[n%uint32(len(healthy))]
+	}
+
+	backend := pool.get(addr)
+	atomic.AddInt64(&backend.active, 1)
+	return addr, func() {
+		atomic.AddInt64(&backend.active, -1)
+	}
+}
+
+// rendezvous picks the address scoring highest for key. Unlike a plain hash
+// modulo the number of backends, only the keys of a backend that goes away
+// move elsewhere.
+func rendezvous(addrs []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(addr))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix64(h.Sum64()); best == "" || score > bestScore {
+			best, bestScore = addr, score
+		}
+	}
+	return best
+}
+
+// mix64 scrambles the bits of an FNV hash, whose high bits barely change
+// between keys that differ only in their last bytes.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
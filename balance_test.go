@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPickBackend(t *testing.T) {
+	backends := []string{"a:1", "b:1", "c:1"}
+	rm := &RouteMapping{Failures: FailurePolicy{Removal: removeNever, BreakerFailures: 1, BreakerCooldown: time.Minute}}
+	add := func(balance string) *Route {
+		return rm.AddRoute("test", Route{FrontendPath: "/" + balance, Backends: backends, Balance: balance, AuthorizedCookie: "c"})
+	}
+	pick := func(route *Route, cookie string, websocket bool) string {
+		addr, release := rm.pickBackend(route, cookie, websocket)
+		release()
+		return addr
+	}
+
+	// Round robin, the default
+	route := add("")
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[pick(route, "user", false)]++
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"a:1": 10, "b:1": 10, "c:1": 10}) {
+		t.Error("Round robin was uneven", counts)
+	}
+	// Websockets stick to the user's backend whatever the policy
+	pinned := pick(route, "user", true)
+	for i := 0; i < 5; i++ {
+		if addr := pick(route, "user", true); addr != pinned {
+			t.Error("Websocket moved from", pinned, "to", addr)
+		}
+	}
+
+	// Least connections
+	route = add(balanceLeastConn)
+	busy, release := rm.pickBackend(route, "user", false)
+	for i := 0; i < 5; i++ {
+		if addr := pick(route, "user", false); addr == busy {
+			t.Error("Least connections picked the busy backend", busy)
+		}
+	}
+	release()
+
+	// Cookie hash spreads users, but keeps each on one backend
+	route = add(balanceCookieHash)
+	users := make(map[string]string)
+	spread := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		user := fmt.Sprintf("user%d", i)
+		users[user] = pick(route, user, false)
+		spread[users[user]] = true
+		if again := pick(route, user, false); again != users[user] {
+			t.Error("User", user, "moved from", users[user], "to", again)
+		}
+	}
+	if len(spread) != len(backends) {
+		t.Error("Users were only spread over", spread)
+	}
+
+	// A failing backend is taken out, and only its users move
+	rm.backendFailed(route, "b:1")
+	if _, err := rm.GetRoute(route.ID); err != nil || !rm.backendAvailable(route) {
+		t.Error("One failing backend took the route down")
+	}
+	for user, addr := range users {
+		moved := pick(route, user, false)
+		if moved == "b:1" || (addr != "b:1" && moved != addr) {
+			t.Error("User", user, "moved from", addr, "to", moved)
+		}
+	}
+}
+
+func TestBalancedProxy(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprint(i)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer backend.Close()
+		addrs = append(addrs, backend.Listener.Addr().String())
+	}
+
+	rm := &RouteMapping{AuthCookieName: "sid"}
+	rm.AddRoute("test", Route{FrontendPath: "/app", Backends: addrs, AuthorizedCookie: "user"})
+	proxy := httptest.NewServer(&requestHandler{
+		Transport:    &http.Transport{},
+		RouteMapping: rm,
+		Frontend:     &frontend{Path: "/gxproxy"},
+	})
+	defer proxy.Close()
+
+	var served string
+	for i := 0; i < 4; i++ {
+		res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		served += string(body)
+	}
+	if served != "0101" {
+		t.Error("Expected requests to alternate between backends, got", served)
+	}
+}
+
+func TestBackendsSerialization(t *testing.T) {
+	route := Route{FrontendPath: "/app", Backends: []string{"a:1", "b:1"}, Balance: balanceLeastConn}
+	data, err := xml.Marshal(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Route
+	if err := xml.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Backends, route.Backends) || restored.Balance != route.Balance {
+		t.Error("Backends did not survive storage", string(data))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What to do with routes whose backend cannot be reached
+const (
+	// removeNever keeps the route, the cleaner removes it once unused.
+	removeNever = "never"
+	// removeAfterFailures removes the route after RemoveAfter consecutive
+	// failures.
+	removeAfterFailures = "after-failures"
+	// removeContainerDead removes the route once its runtime confirms that
+	// one of its containers is dead.
+	removeContainerDead = "container-dead"
+)
+
+var removalPolicies = map[string]bool{removeNever: true, removeAfterFailures: true, removeContainerDead: true}
+
+// FailurePolicy describes how failures to reach the backend of a route are
+// handled.
+type FailurePolicy struct {
+	// DialAttempts is how often connecting to a backend is tried for each
+	// request. Less than two means no retries.
+	DialAttempts int
+	// DialBackoff is the delay before the first retry, doubled for every
+	// further one.
+	DialBackoff time.Duration
+	// BreakerFailures consecutive failures within BreakerWindow open the
+	// route's circuit: requests fail straight away for BreakerCooldown,
+	// without trying the backend. Zero disables the breaker.
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+	// Removal is one of never, after-failures or container-dead. Empty
+	// removes the route on the first failure.
+	Removal string
+	// RemoveAfter is the number of consecutive failures within
+	// BreakerWindow after which the after-failures policy removes a route.
+	RemoveAfter int
+}
+
+// breakerState tracks the recent failures of a route's backend.
+type breakerState struct {
+	mu sync.Mutex
+	// consecutive failures, the first of which happened at first
+	consecutive int
+	first       time.Time
+	openUntil   time.Time
+	// checking is 1 while a container-dead check is running, only accessed
+	// atomically.
+	checking int32
+}
+
+// allow reports whether requests may be sent to the backend, i.e. the
+// circuit is closed.
+func (b *breakerState) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.openUntil)
+}
+
+// failure records a failure, opening the circuit if there were too many,
+// and returns the number of consecutive failures within the window.
+func (b *breakerState) failure(p FailurePolicy, now time.Time) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive == 0 || (p.BreakerWindow > 0 && now.Sub(b.first) > p.BreakerWindow) {
+		b.consecutive = 0
+		b.first = now
+	}
+	b.consecutive++
+	opened := false
+	if p.BreakerFailures > 0 && b.consecutive >= p.BreakerFailures {
+		opened = !now.Before(b.openUntil)
+		b.openUntil = now.Add(p.BreakerCooldown)
+	}
+	return b.consecutive, opened
+}
+
+// success closes the circuit.
+func (b *breakerState) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive = 0
+	b.openUntil = time.Time{}
+}
+
+// dialContext connects to a backend, retrying failed attempts with
+// exponential backoff. A container being restarted is usually back within
+// a few hundred milliseconds.
+func (p FailurePolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	backoff := p.DialBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		atomic.AddInt64(&metrics.dialFailures, 1)
+		if attempt >= p.DialAttempts {
+			return nil, err
+		}
+		log.Debugf("Connecting to %s failed, retrying in %s: %s", addr, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// backendAvailable reports whether requests should be sent to a route's
+// backend, rather than failed straight away because its circuit is open.
+func (rm *RouteMapping) backendAvailable(route *Route) bool {
+	return route.live.breaker.allow(time.Now())
+}
+
+// backendSucceeded records that a backend of a route answered.
+func (rm *RouteMapping) backendSucceeded(route *Route, addr string) {
+	route.live.backends.get(addr).breaker.success()
+	route.live.breaker.success()
+}
+
+// backendFailed records that a backend of a route could not be reached, and
+// applies the removal policy. Each backend has a circuit of its own, which
+// takes it out of the rotation, while the route's circuit and the removal
+// policy only count failures once no backend of the route is left.
+func (rm *RouteMapping) backendFailed(route *Route, addr string) {
+	policy := rm.Failures
+	now := time.Now()
+	_, opened := route.live.backends.get(addr).breaker.failure(policy, now)
+	if len(route.backendAddrs()) > 1 {
+		if opened {
+			routeFields(route).backend(addr).Warningf("Backend keeps failing, sending requests elsewhere for %s", policy.BreakerCooldown)
+		}
+		// The other backends still take the route's requests
+		if len(route.healthyBackends(now)) > 0 {
+			return
+		}
+	}
+	failures, opened := route.live.breaker.failure(policy, now)
+	if opened {
+		routeFields(route).Warningf("Backend failed %d times, pausing requests for %s", failures, policy.BreakerCooldown)
+	}
+
+	switch policy.Removal {
+	case removeNever:
+	case removeAfterFailures:
+		if failures >= policy.RemoveAfter {
+			rm.RemoveRoute(actorDeadBackend, route, fmt.Sprintf("backend unreachable %d times", failures))
+		}
+	case removeContainerDead:
+		// Only one check at a time, several requests usually fail together
+		if atomic.CompareAndSwapInt32(&route.live.breaker.checking, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&route.live.breaker.checking, 0)
+				rm.removeIfContainerDead(route)
+			}()
+		}
+	default:
+		rm.RemoveRoute(actorDeadBackend, route, "backend unreachable")
+	}
+}
+
+// removeIfContainerDead asks the runtime whether the containers of a route
+// with an unreachable backend are still alive, and removes the route if one
+// is not.
+func (rm *RouteMapping) removeIfContainerDead(route *Route) {
+	rt := rm.runtimeFor(route)
+	for _, id := range route.ContainerIds {
+		alive, err := rt.Alive(id)
+		if err != nil {
+			routeFields(route).err(err).Warningf("Could not check container %s", id)
+			continue
+		}
+		if !alive {
+			rm.RemoveRoute(actorDeadBackend, route, fmt.Sprintf("backend unreachable and container %s is dead", id))
+			return
+		}
+	}
+}
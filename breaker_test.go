@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	policy := FailurePolicy{DialAttempts: 1}
+	if _, err := policy.dialContext(context.Background(), "tcp", addr); err == nil {
+		t.Fatal("Expected a single attempt to fail")
+	}
+
+	// The backend comes back while we retry
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		l.Close()
+	}()
+	policy = FailurePolicy{DialAttempts: 6, DialBackoff: 20 * time.Millisecond}
+	conn, err := policy.dialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal("Retries did not reach the backend", err)
+	}
+	conn.Close()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	policy := FailurePolicy{BreakerFailures: 3, BreakerWindow: time.Minute, BreakerCooldown: time.Minute}
+	var b breakerState
+	now := time.Now()
+
+	for i := 1; i <= 2; i++ {
+		if n, opened := b.failure(policy, now); n != i || opened {
+			t.Error("Failure", i, "counted as", n, opened)
+		}
+	}
+	if !b.allow(now) {
+		t.Error("Circuit opened too early")
+	}
+	if _, opened := b.failure(policy, now); !opened || b.allow(now) {
+		t.Error("Circuit did not open after 3 failures")
+	}
+	if !b.allow(now.Add(2 * time.Minute)) {
+		t.Error("Circuit did not close after the cooldown")
+	}
+	b.success()
+	if !b.allow(now) {
+		t.Error("Circuit did not close on success")
+	}
+
+	// Failures spread out further than the window don't add up
+	for i := 0; i < 3; i++ {
+		if n, _ := b.failure(policy, now.Add(time.Duration(i)*2*time.Minute)); n != 1 {
+			t.Error("Failure outside the window counted as", n)
+		}
+	}
+}
+
+// mortalRuntime reports the containers in dead as no longer alive.
+type mortalRuntime struct {
+	noopRuntime
+	dead map[string]bool
+}
+
+func (m mortalRuntime) Alive(id string) (bool, error) {
+	return !m.dead[id], nil
+}
+
+func TestFailurePolicyRemoval(t *testing.T) {
+	tests := []struct {
+		Removal    string
+		Containers []string
+		Failures   int
+		Removed    bool
+	}{
+		{"", nil, 1, true},
+		{removeNever, nil, 20, false},
+		{removeAfterFailures, nil, 2, false},
+		{removeAfterFailures, nil, 3, true},
+		{removeContainerDead, []string{"alive"}, 5, false},
+		{removeContainerDead, []string{"alive", "dead"}, 1, true},
+	}
+	for _, tc := range tests {
+		rm := &RouteMapping{
+			Failures:       FailurePolicy{Removal: tc.Removal, RemoveAfter: 3},
+			Runtimes:       map[string]ContainerRuntime{runtimeDocker: mortalRuntime{dead: map[string]bool{"dead": true}}},
+			DefaultRuntime: runtimeDocker,
+		}
+		route := rm.AddRoute("test", Route{FrontendPath: "/app", BackendAddr: "x", AuthorizedCookie: "c", ContainerIds: tc.Containers})
+		for i := 0; i < tc.Failures; i++ {
+			rm.backendFailed(route, "x")
+		}
+		if tc.Removal == removeContainerDead && tc.Removed {
+			eventually(t, "the route to be removed", func() bool { return rm.Len() == 0 })
+		} else if tc.Removal == removeContainerDead {
+			// Give the check a chance to (wrongly) remove the route
+			time.Sleep(50 * time.Millisecond)
+		}
+		if removed := rm.Len() == 0; removed != tc.Removed {
+			t.Error("Policy", tc.Removal, "after", tc.Failures, "failures removed the route:", removed)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// eventResubscribeDelay is how long to wait between attempts to resubscribe
+// to container events.
+const eventResubscribeDelay = 5 * time.Second
+
+// shortContainerID is the length of the abbreviated container IDs shown by
+// Docker. Shorter IDs of routes only match a container exactly.
+const shortContainerID = 12
+
+// WatchContainers subscribes to the event streams of every runtime which has
+// one, and removes a route as soon as one of its containers dies or is
+// removed, rather than waiting for the route to expire or for a request to
+// hit the dead backend.
+func (rm *RouteMapping) WatchContainers() error {
+	var failed []string
+	for name, rt := range rm.Runtimes {
+		watcher, ok := rt.(containerWatcher)
+		if !ok {
+			continue
+		}
+		name := name
+		err := watcher.WatchDeaths(func(id string, event string) {
+			rm.handleContainerDeath(name, id, event)
+		})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not watch %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// handleContainerDeath removes every route which uses a container that just
+// died, unless the removal policy keeps routes with dead backends. Where
+// proxies share their routes, only the holder of the cleaner lease removes
+// them, so that they are torn down once.
+func (rm *RouteMapping) handleContainerDeath(runtime string, id string, event string) {
+	switch rm.Failures.Removal {
+	case removeNever, removeAfterFailures:
+		return
+	}
+	if !rm.holdsCleanerLease() {
+		return
+	}
+	for _, route := range rm.routesForContainer(runtime, id) {
+		rm.RemoveRoute(actorEvents, route, fmt.Sprintf("container %s received %s event %s", id, runtime, event))
+	}
+}
+
+// routesForContainer finds the routes associated with a container of the
+// given runtime. Routes may list either full container IDs or ones
+// abbreviated to at least shortContainerID characters.
+func (rm *RouteMapping) routesForContainer(runtime string, id string) []*Route {
+	var routes []*Route
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	for _, route := range rm.routes {
+		if rm.runtimeName(route) != runtime {
+			continue
+		}
+		for _, containerID := range route.ContainerIds {
+			if containerID == id || (len(containerID) >= shortContainerID && strings.HasPrefix(id, containerID)) {
+				routes = append(routes, route)
+				break
+			}
+		}
+	}
+	return routes
+}
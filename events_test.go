@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeDocker is a minimal Docker API serving a scripted event stream and
+// recording kill requests.
+type fakeDocker struct {
+	*httptest.Server
+	events chan docker.APIEvents
+	stop   chan struct{}
+
+	mu     sync.Mutex
+	killed []string
+}
+
+func newFakeDocker() *fakeDocker {
+	d := &fakeDocker{
+		events: make(chan docker.APIEvents),
+		stop:   make(chan struct{}),
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/events":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			encoder := json.NewEncoder(w)
+			for {
+				select {
+				case event := <-d.events:
+					_ = encoder.Encode(event)
+					w.(http.Flusher).Flush()
+				case <-d.stop:
+					return
+				}
+			}
+		case strings.HasSuffix(r.URL.Path, "/kill"):
+			d.mu.Lock()
+			d.killed = append(d.killed, strings.Split(r.URL.Path, "/")[2])
+			d.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return d
+}
+
+// Close ends any event streams before shutting down the server.
+func (d *fakeDocker) Close() {
+	close(d.stop)
+	d.Server.Close()
+}
+
+func (d *fakeDocker) Killed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.killed...)
+}
+
+func TestWatchContainers(t *testing.T) {
+	fake := newFakeDocker()
+	defer fake.Close()
+
+	client, err := docker.NewClient("tcp://" + fake.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := &RouteMapping{
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: &dockerRuntime{client: client}},
+		DefaultRuntime: runtimeDocker,
+	}
+	doomed := rm.AddRoute("test", Route{
+		FrontendPath:     "/ipython/1",
+		BackendAddr:      "127.0.0.1:1",
+		AuthorizedCookie: "gxsesh",
+		ContainerIds:     []string{"deadbeef0001", "cafebabe0001"},
+	})
+	rm.AddRoute("test", Route{
+		FrontendPath:     "/ipython/2",
+		BackendAddr:      "127.0.0.1:2",
+		AuthorizedCookie: "gxsesh",
+		ContainerIds:     []string{"deadbeef0002", "dead"}, // too short to abbreviate deadbeef0001
+	})
+	if err := rm.WatchContainers(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	events := []docker.APIEvents{
+		// Not a death, and not one of ours
+		{Status: "start", ID: "deadbeef0002" + strings.Repeat("0", 52), Time: now},
+		{Status: "die", ID: "0123456789ab" + strings.Repeat("0", 52), Time: now},
+		{Status: "die", ID: "deadbeef0001" + strings.Repeat("0", 52), Time: now},
+	}
+	for _, event := range events {
+		select {
+		case fake.events <- event:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Proxy never subscribed to events")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rm.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := rm.GetRoute(doomed.ID); err == nil {
+		t.Fatal("Route with a dead container was not removed")
+	}
+	if _, err := rm.FindRoute("/ipython/2", "gxsesh"); err != nil {
+		t.Error("Unrelated route was removed")
+	}
+
+	rm.WaitTeardowns()
+	removals := rm.Removals()
+	if len(removals) != 1 || removals[0].Route.ID != doomed.ID || !strings.Contains(removals[0].Reason, "die") {
+		t.Error("Removal was not recorded with its reason", removals)
+	}
+	// The surviving container of the route is cleaned up as well, the order
+	// depends on the parallel teardown
+	killed := fake.Killed()
+	sort.Strings(killed)
+	if len(killed) != 2 || killed[0] != "cafebabe0001" {
+		t.Error("Expected the route's containers to be killed, found", killed)
+	}
+}
+
+// leaseStore is a store shared with other proxies, which may hold the
+// cleaner lease.
+type leaseStore struct {
+	RouteStore
+	held bool
+}
+
+func (s *leaseStore) HoldsLease() bool {
+	return s.held
+}
+
+func TestContainerDeathPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &leaseStore{RouteStore: newXMLStore(filepath.Join(dir, "routes.xml"), 0, routeMappingFile{})}
+	rm := &RouteMapping{
+		Store:          store,
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: &recordingRuntime{}},
+		DefaultRuntime: runtimeDocker,
+	}
+	route := rm.AddRoute("test", Route{FrontendPath: "/ipython", BackendAddr: "a", AuthorizedCookie: "c", ContainerIds: []string{"deadbeef0001"}})
+	died := "deadbeef0001" + strings.Repeat("0", 52)
+
+	store.held = true
+	for _, policy := range []string{removeNever, removeAfterFailures} {
+		rm.Failures.Removal = policy
+		rm.handleContainerDeath(runtimeDocker, died, "die")
+		if _, err := rm.GetRoute(route.ID); err != nil {
+			t.Error("Route was removed despite policy", policy)
+		}
+	}
+	rm.Failures.Removal = removeContainerDead
+	store.held = false
+	rm.handleContainerDeath(runtimeDocker, died, "die")
+	if _, err := rm.GetRoute(route.ID); err != nil {
+		t.Error("Route was removed by a proxy without the lease")
+	}
+	store.held = true
+	rm.handleContainerDeath(runtimeDocker, died, "die")
+	if _, err := rm.GetRoute(route.ID); err == nil {
+		t.Error("Route was kept by the holder of the lease")
+	}
+	rm.WaitTeardowns()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeCheckInterval is how often the daemon of the default runtime is
+// pinged. Probes are answered from the latest outcome, so they need not wait
+// for a daemon which takes dockerPingTimeout to fail.
+const runtimeCheckInterval = 5 * time.Second
+
+// runtimePinger is implemented by runtimes whose daemon can be checked.
+type runtimePinger interface {
+	// Ping reports why the daemon cannot be reached, if it cannot.
+	Ping() error
+}
+
+// readinessCheck is the outcome of one of the checks behind /readyz.
+type readinessCheck struct {
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// readiness reports whether the proxy can serve routes: their storage was
+// loaded, the daemon of the default runtime answered its latest ping and the
+// frontend is listening.
+func (f *frontend) readiness(rm *RouteMapping) (bool, map[string]readinessCheck) {
+	checks := map[string]readinessCheck{
+		"storage":  {Ready: atomic.LoadInt32(&rm.restored) == 1},
+		"runtime":  {Ready: true},
+		"listener": {Ready: atomic.LoadInt32(&f.listening) == 1},
+	}
+	if !checks["storage"].Ready {
+		checks["storage"] = readinessCheck{Error: "routes not restored yet"}
+	}
+	if _, ok := rm.Runtimes[rm.DefaultRuntime].(runtimePinger); ok {
+		check, checked := f.runtimeCheck.Load().(readinessCheck)
+		if !checked {
+			check = readinessCheck{Error: "runtime not checked yet"}
+		}
+		checks["runtime"] = check
+	}
+	if !checks["listener"].Ready {
+		checks["listener"] = readinessCheck{Error: "not listening on " + f.Addr}
+	}
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Ready
+	}
+	return ready, checks
+}
+
+// checkRuntime pings the daemon of the default runtime, if it has one, and
+// keeps the outcome for readiness.
+func (f *frontend) checkRuntime(rm *RouteMapping) {
+	pinger, ok := rm.Runtimes[rm.DefaultRuntime].(runtimePinger)
+	if !ok {
+		return
+	}
+	check := readinessCheck{Ready: true}
+	if err := pinger.Ping(); err != nil {
+		check = readinessCheck{Error: err.Error()}
+	}
+	f.runtimeCheck.Store(check)
+}
+
+// watchRuntime checks the default runtime every runtimeCheckInterval.
+func (f *frontend) watchRuntime(rm *RouteMapping) {
+	f.checkRuntime(rm)
+	for range time.Tick(runtimeCheckInterval) {
+		f.checkRuntime(rm)
+	}
+}
+
+// handleHealth serves the probes of orchestrators, which need no API key:
+// /healthz answers as long as the process runs, /readyz once it can serve
+// routes.
+func (f *frontend) handleHealth(mux *http.ServeMux, rm *RouteMapping) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, checks := f.readiness(rm)
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		renderJSON(w, status, struct {
+			Ready  bool                      `json:"ready"`
+			Checks map[string]readinessCheck `json:"checks"`
+		}{ready, checks})
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// pingRuntime is a runtime whose daemon answers pings with err.
+type pingRuntime struct {
+	noopRuntime
+	err error
+}
+
+func (p *pingRuntime) Ping() error {
+	return p.err
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	rt := &pingRuntime{err: errors.New("could not reach the daemon")}
+	rm := &RouteMapping{
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: rt},
+		DefaultRuntime: runtimeDocker,
+	}
+	f := &frontend{Addr: "127.0.0.1:8800", AdminAddr: "127.0.0.1:9090", APIKeys: testKeyring()}
+	admin := httptest.NewServer(f.adminHandler(rm))
+	defer admin.Close()
+
+	data, code, err := get(admin, "/healthz")
+	if err != nil || code != http.StatusOK || data != "ok\n" {
+		t.Error("Health check answered", code, data, err)
+	}
+
+	var ready struct {
+		Ready  bool
+		Checks map[string]readinessCheck
+	}
+	readyz := func(expected int) {
+		data, code, err := get(admin, "/readyz")
+		if err != nil || code != expected {
+			t.Fatal("Readiness check answered", code, data, err)
+		}
+		ready.Checks = nil
+		if err := json.Unmarshal([]byte(data), &ready); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readyz(http.StatusServiceUnavailable)
+	if ready.Ready || len(ready.Checks) != 3 {
+		t.Error("Expected three failed checks, found", ready)
+	}
+	for name, check := range ready.Checks {
+		if check.Ready || check.Error == "" {
+			t.Error("Expected", name, "to fail, found", check)
+		}
+	}
+
+	// Probes report the latest ping rather than waiting for one
+	atomic.StoreInt32(&rm.restored, 1)
+	atomic.StoreInt32(&f.listening, 1)
+	f.checkRuntime(rm)
+	pingErr := rt.err
+	rt.err = nil
+	readyz(http.StatusServiceUnavailable)
+	if !ready.Checks["storage"].Ready || !ready.Checks["listener"].Ready || ready.Checks["runtime"].Error != pingErr.Error() {
+		t.Error("Expected only the runtime to fail, found", ready)
+	}
+	f.checkRuntime(rm)
+	readyz(http.StatusOK)
+	if !ready.Ready {
+		t.Error("Expected to be ready, found", ready)
+	}
+
+	// With an admin listener the checks are not served with the proxy
+	proxy := httptest.NewServer(f.handler(rm))
+	defer proxy.Close()
+	if _, code, _ := get(proxy, "/readyz"); code == http.StatusOK {
+		t.Error("Readiness check was served with the proxy")
+	}
+	f.AdminAddr = ""
+	withoutAdmin := httptest.NewServer(f.handler(rm))
+	defer withoutAdmin.Close()
+	if _, code, _ := get(withoutAdmin, "/readyz"); code != http.StatusOK {
+		t.Error("Readiness check was not served without an admin listener", code)
+	}
+
+	// Hosts of host routes keep their own /healthz
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ie " + r.URL.Path))
+	}))
+	defer backend.Close()
+	rm.AuthCookieName = "sid"
+	rm.AddRoute("test", Route{Host: "abc.gie.example.org", FrontendPath: "/", BackendAddr: backend.Listener.Addr().String(), AuthorizedCookie: "user"})
+	req := proxyRequest(withoutAdmin, "/healthz")
+	req.Host = "abc.gie.example.org"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ie /healthz" {
+		t.Error("Health check shadowed the host route, got", res.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// hostKey prefixes the index keys of routes with a Host. The NUL byte cannot
+// start a request path, so host routes never match a path-only lookup.
+func hostKey(pattern string) string {
+	return "\x00" + pattern
+}
+
+// indexKey is the key of the route in the radix tree of its user: its
+// FrontendPath, preceded by its Host if it has one.
+func (r *Route) indexKey() string {
+	if r.Host == "" {
+		return r.FrontendPath
+	}
+	return hostKey(r.Host) + r.FrontendPath
+}
+
+// requestHost returns the host name of a request's Host header, without its
+// port or a trailing dot, in lower case.
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostPatterns lists the Host values a route may have to match host, most
+// specific first: the host itself, then wildcards for each of its parent
+// domains.
+func hostPatterns(host string) []string {
+	if host == "" {
+		return nil
+	}
+	patterns := []string{host}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		host = host[i+1:]
+		patterns = append(patterns, "*."+host)
+		i = strings.IndexByte(host, '.')
+	}
+	return patterns
+}
+
+// normalizeHost validates the Host of a route, returning it in lower case.
+// It is a host name, optionally with a leading *. wildcard label, and no port.
+func normalizeHost(pattern string) (string, bool) {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/\x00 ") {
+		return "", false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return "", false
+		}
+	}
+	return pattern, true
+}
+
+// countHostLocked adds delta to the number of routes for the Host of route,
+// if it has one. The caller must hold rm.mu for writing.
+func (rm *RouteMapping) countHostLocked(route *Route, delta int) {
+	if route.Host == "" {
+		return
+	}
+	rm.hosts[route.Host] += delta
+	if rm.hosts[route.Host] <= 0 {
+		delete(rm.hosts, route.Host)
+	}
+}
+
+// ServesHost reports whether any user has a route for host, which may carry a
+// port. Such hosts belong to their routes entirely.
+func (rm *RouteMapping) ServesHost(host string) bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	for _, pattern := range hostPatterns(requestHost(host)) {
+		if rm.hosts[pattern] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether a route for pattern would serve host.
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// apiHosts lists the hosts the API and health checks are reached by: the
+// configured API host, localhost and the address listened on.
+func (f *frontend) apiHosts() []string {
+	hosts := []string{"localhost"}
+	if f.APIHost != "" {
+		hosts = append(hosts, requestHost(f.APIHost))
+	}
+	if host, _, err := net.SplitHostPort(f.Addr); err == nil && host != "" {
+		hosts = append(hosts, requestHost(host))
+	}
+	return hosts
+}
+
+// isAPIHost reports whether a request's Host is one the API is reached by,
+// which host routes never take over.
+func (f *frontend) isAPIHost(host string) bool {
+	host = requestHost(host)
+	for _, api := range f.apiHosts() {
+		if host == api {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHost reports whether a route may have the normalized Host pattern.
+// Routes may not take over the hosts of the API, IP addresses, or a whole
+// top level domain.
+func (f *frontend) allowedHost(pattern string) bool {
+	name := strings.TrimPrefix(pattern, "*.")
+	if net.ParseIP(name) != nil {
+		return false
+	}
+	if name != pattern && !strings.Contains(name, ".") {
+		return false
+	}
+	for _, api := range f.apiHosts() {
+		if hostMatches(pattern, api) {
+			return false
+		}
+	}
+	return true
+}
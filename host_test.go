@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHostPatterns(t *testing.T) {
+	if got := hostPatterns(requestHost("ABC.gie.example.org.:8443")); !reflect.DeepEqual(got, []string{
+		"abc.gie.example.org", "*.gie.example.org", "*.example.org", "*.org",
+	}) {
+		t.Error("Unexpected patterns", got)
+	}
+
+	tests := map[string]string{
+		"Abc.Example.org":  "abc.example.org",
+		"*.example.org":    "*.example.org",
+		"*.example.org.":   "*.example.org",
+		"":                 "",
+		"*.":               "",
+		"a.*.example.org":  "",
+		"example.org:8080": "",
+		"example..org":     "",
+		"example.org/path": "",
+		"**.example.org":   "",
+	}
+	for pattern, expected := range tests {
+		host, ok := normalizeHost(pattern)
+		if host != expected || ok != (expected != "") {
+			t.Errorf("%q normalized to %q, %v", pattern, host, ok)
+		}
+	}
+}
+
+func TestFindHostRoute(t *testing.T) {
+	rm := &RouteMapping{}
+	exact := rm.AddRoute("test", Route{Host: "abc.gie.example.org", FrontendPath: "/", BackendAddr: "exact", AuthorizedCookie: "c"})
+	wildcard := rm.AddRoute("test", Route{Host: "*.gie.example.org", FrontendPath: "/", BackendAddr: "wildcard", AuthorizedCookie: "c"})
+	api := rm.AddRoute("test", Route{Host: "*.gie.example.org", FrontendPath: "/api", BackendAddr: "api", AuthorizedCookie: "c"})
+	path := rm.AddRoute("test", Route{FrontendPath: "/", BackendAddr: "path", AuthorizedCookie: "c"})
+
+	tests := []struct {
+		Host, URL, Cookie string
+		Expected          *Route
+	}{
+		{"abc.gie.example.org", "/tree", "c", exact},
+		{"ABC.gie.example.org:443", "/api/x", "c", exact},
+		{"def.gie.example.org", "/tree", "c", wildcard},
+		{"x.def.gie.example.org", "/api/x", "c", api},
+		{"abc.gie.example.org", "/tree", "other", nil},
+		{"gie.example.org", "/tree", "c", nil},
+		{"proxy.example.com", "/tree", "c", nil},
+	}
+	for _, tc := range tests {
+		route, err := rm.FindHostRoute(tc.Host, tc.URL, tc.Cookie)
+		if tc.Expected == nil && err != errRouteNotFound {
+			t.Error(tc.Host, tc.URL, "found", route)
+		} else if tc.Expected != nil && route != tc.Expected {
+			t.Error(tc.Host, tc.URL, "found", route, err)
+		}
+	}
+	// Host routes stay out of the way of path routes
+	if route, err := rm.FindRoute("/tree", "c"); err != nil || route != path {
+		t.Error("Path lookup found", route, err)
+	}
+}
+
+func TestHostRoutingProxy(t *testing.T) {
+	proxy, rm, _ := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("path " + r.URL.Path))
+	}))
+	_, hostRM, _ := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host " + r.URL.Path))
+	}))
+	backend := hostRM.Snapshot()[0].BackendAddr
+	rm.AddRoute("test", Route{Host: "*.gie.example.org", FrontendPath: "/", BackendAddr: backend, AuthorizedCookie: "user"})
+
+	fetch := func(host, path string) (int, string) {
+		req := proxyRequest(proxy, path)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := fetch("abc.gie.example.org", "/rstudio/"); code != http.StatusOK || body != "host /rstudio/" {
+		t.Error("Host route was not served at the root, got", code, body)
+	}
+	if code, body := fetch("proxy.example.org", "/gxproxy/app/"); code != http.StatusOK || body != "path /gxproxy/app/" {
+		t.Error("Path route was not served alongside, got", code, body)
+	}
+	if code, _ := fetch("proxy.example.org", "/rstudio/"); code != http.StatusBadRequest {
+		t.Error("Request outside the prefix was answered with", code)
+	}
+}
+
+func TestHostRoutesShadowAPI(t *testing.T) {
+	_, rm, _ := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host " + r.URL.Path))
+	}))
+	backend := rm.Snapshot()[0].BackendAddr
+	route := rm.AddRoute("test", Route{Host: "abc.gie.example.org", FrontendPath: "/", BackendAddr: backend, AuthorizedCookie: "user"})
+	f := &frontend{Path: "/gxproxy", APIKeys: testKeyring()}
+	proxy := httptest.NewServer(f.handler(rm))
+	defer proxy.Close()
+
+	fetch := func(host, path string) (int, string) {
+		req := proxyRequest(proxy, path)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	// Jupyter has an API of its own
+	if code, body := fetch("abc.gie.example.org:8080", "/api/kernels"); code != http.StatusOK || body != "host /api/kernels" {
+		t.Error("Host route did not get its /api, got", code, body)
+	}
+	if code, _ := fetch("proxy.example.org", "/api/kernels"); code != http.StatusUnauthorized {
+		t.Error("API was not served on the proxy's own host, got", code)
+	}
+	rm.RemoveRoute("test", route, "test")
+	if code, _ := fetch("abc.gie.example.org", "/api/kernels"); code != http.StatusUnauthorized {
+		t.Error("API was not served once the host route was gone, got", code)
+	}
+}
+
+func TestHostRoutesSpareAPIHost(t *testing.T) {
+	_, rm, _ := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host " + r.URL.Path))
+	}))
+	backend := rm.Snapshot()[0].BackendAddr
+	f := &frontend{Addr: "127.0.0.1:8800", Path: "/gxproxy", APIHost: "api.gie.example.org", APIKeys: testKeyring()}
+	proxy := httptest.NewServer(f.handler(rm))
+	defer proxy.Close()
+
+	for host, expected := range map[string]int{
+		"*.gie.example.org":   http.StatusBadRequest,
+		"API.gie.example.org": http.StatusBadRequest,
+		"*.org":               http.StatusBadRequest,
+		"localhost":           http.StatusBadRequest,
+		"127.0.0.1":           http.StatusBadRequest,
+		"abc.gie.example.org": http.StatusCreated,
+	} {
+		route := fmt.Sprintf(`{"Host": %q, "BackendAddr": %q, "AuthorizedCookie": "user"}`, host, backend)
+		if data, code, err := post(proxy, "/api/routes?api_key=supersecret", []byte(route)); err != nil || code != expected {
+			t.Error("Route for host", host, "answered", code, data, err)
+		}
+	}
+
+	// Routes stored before hosts were checked do not hide the API either
+	rm.AddRoute("test", Route{Host: "*.gie.example.org", FrontendPath: "/", BackendAddr: backend, AuthorizedCookie: "user"})
+	fetch := func(host, path string) (int, string) {
+		req := proxyRequest(proxy, path)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := fetch("api.gie.example.org", "/api"); code != http.StatusUnauthorized {
+		t.Error("API was hidden by a wildcard route, got", code, body)
+	}
+	if code, body := fetch("xyz.gie.example.org", "/api/kernels"); code != http.StatusOK || body != "host /api/kernels" {
+		t.Error("Wildcard route did not get its /api, got", code, body)
+	}
+}
@@ -1,19 +1,255 @@
 package main
 
 import (
-	"github.com/op/go-logging"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// Formats of the log
+const (
+	logText = "text"
+	logJSON = "json"
 )
 
 var log = logging.MustGetLogger("main")
 
-func setupLogging() {
-	format := logging.MustStringFormatter(
-		"%{color}%{time:15:04:05.000} %{shortfunc} > %{level:.4s} %{id:03x}%{color:reset} %{message}",
-	)
-	backend1 := logging.NewLogBackend(os.Stderr, "", 0)
-	backend1Leveled := logging.AddModuleLevel(backend1)
-	backend1Leveled.SetLevel(logging.DEBUG, "")
-	logging.SetFormatter(format)
-	log.SetBackend(backend1Leveled)
+// fieldLog is used by logFields, which add a frame between the caller and
+// the logger.
+var fieldLog = func() *logging.Logger {
+	l := logging.MustGetLogger("main")
+	l.ExtraCalldepth = 1
+	return l
+}()
+
+// setupLogging sends the log to file, or stderr if empty, in the given
+// format from level on.
+func setupLogging(format, level, file string) error {
+	backend, err := newLogBackend(format, level, file)
+	if err != nil {
+		return err
+	}
+	logging.SetBackend(backend)
+	return nil
+}
+
+func newLogBackend(format, level, file string) (logging.LeveledBackend, error) {
+	lvl, err := logging.LogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	if format != logText && format != logJSON {
+		return nil, fmt.Errorf("unknown log format %s, expected %s or %s", format, logText, logJSON)
+	}
+	var out io.Writer = os.Stderr
+	pattern := "%{color}%{time:15:04:05.000} %{shortfunc} > %{level:.4s} %{id:03x}%{color:reset} %{message}"
+	if file != "" {
+		f, err := openLogFile(file)
+		if err != nil {
+			return nil, err
+		}
+		onHangup(func() {
+			if err := f.Reopen(); err != nil {
+				log.Errorf("Could not reopen the log file %s: %s", file, err)
+			}
+		})
+		out = f
+		// Colours are for terminals
+		pattern = "%{time:2006-01-02 15:04:05.000} %{shortfunc} > %{level:.4s} %{id:03x} %{message}"
+	}
+
+	var formatter logging.Formatter = jsonFormatter{}
+	if format == logText {
+		formatter = textFormatter{logging.MustStringFormatter(pattern)}
+	}
+	backend := logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), formatter))
+	backend.SetLevel(lvl, "")
+	return backend, nil
+}
+
+// logFile is a log file which can be reopened after logrotate moved it.
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	return l, l.Reopen()
+}
+
+// Reopen opens the file at the path of the log again, keeping the current
+// one if that fails.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.file
+	l.file = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(p)
+}
+
+// logFields are what a log message is about. They are kept apart from the
+// message, so that the JSON log has a key for each. Never put cookies or
+// API keys in here.
+type logFields struct {
+	Route     string `json:"route,omitempty"`
+	Frontend  string `json:"frontend,omitempty"`
+	Backend   string `json:"backend,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// routeFields describe a route.
+func routeFields(route *Route) logFields {
+	return logFields{
+		Route:    route.ID,
+		Frontend: route.Host + route.FrontendPath,
+		Backend:  strings.Join(route.backendAddrs(), ","),
+	}
+}
+
+// request adds who made a request.
+func (f logFields) request(r *http.Request) logFields {
+	f.Remote = r.RemoteAddr
+	f.RequestID = r.Header.Get(requestIDHeader)
+	return f
+}
+
+// backend narrows the fields down to one backend of the route.
+func (f logFields) backend(addr string) logFields {
+	f.Backend = addr
+	return f
+}
+
+// err adds what went wrong.
+func (f logFields) err(err error) logFields {
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+// Format prints nothing, logFields are added to the message by the
+// formatters.
+func (f logFields) Format(fmt.State, rune) {}
+
+// String writes the fields as key=value pairs, for the text log.
+func (f logFields) String() string {
+	var b strings.Builder
+	for _, field := range []struct{ key, value string }{
+		{"route", f.Route},
+		{"frontend", f.Frontend},
+		{"backend", f.Backend},
+		{"remote", f.Remote},
+		{"request_id", f.RequestID},
+		{"error", f.Error},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if strings.ContainsAny(field.value, " \"=") {
+			field.value = fmt.Sprintf("%q", field.value)
+		}
+		fmt.Fprintf(&b, " %s=%s", field.key, field.value)
+	}
+	return b.String()
+}
+
+// The logFields go last into the record, where they print nothing.
+func (f logFields) Debugf(format string, args ...interface{}) {
+	fieldLog.Debugf(format+"%v", append(args, f)...)
+}
+
+func (f logFields) Infof(format string, args ...interface{}) {
+	fieldLog.Infof(format+"%v", append(args, f)...)
+}
+
+func (f logFields) Warningf(format string, args ...interface{}) {
+	fieldLog.Warningf(format+"%v", append(args, f)...)
+}
+
+func (f logFields) Errorf(format string, args ...interface{}) {
+	fieldLog.Errorf(format+"%v", append(args, f)...)
+}
+
+// recordFields finds the logFields of a log record.
+func recordFields(r *logging.Record) (logFields, bool) {
+	if len(r.Args) > 0 {
+		f, ok := r.Args[len(r.Args)-1].(logFields)
+		return f, ok
+	}
+	return logFields{}, false
+}
+
+// textFormatter appends the logFields of a record to its message.
+type textFormatter struct {
+	logging.Formatter
+}
+
+func (t textFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	if err := t.Formatter.Format(calldepth+1, r, w); err != nil {
+		return err
+	}
+	if f, ok := recordFields(r); ok {
+		_, err := io.WriteString(w, f.String())
+		return err
+	}
+	return nil
+}
+
+// jsonFormatter writes a record as a JSON object on a line of its own.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	f, _ := recordFields(r)
+	line, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Level   string `json:"level"`
+		Message string `json:"message"`
+		logFields
+	}{r.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"), r.Level.String(), r.Message(), f})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(line)
+	return err
+}
+
+// requestIDHeader identifies a request across the proxy, its backend and
+// whatever is in front of the proxy.
+const requestIDHeader = "X-Request-Id"
+
+// setRequestID gives a request an ID, unless it came with one.
+func setRequestID(r *http.Request) {
+	if r.Header.Get(requestIDHeader) != "" {
+		return
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return
+	}
+	r.Header.Set(requestIDHeader, hex.EncodeToString(buf))
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// testBackend lets tests swap where the log goes. go-logging's own backend
+// cannot be replaced while goroutines of earlier tests still log.
+type testBackend struct {
+	mu    sync.Mutex
+	inner logging.Backend
+}
+
+var testLog = &testBackend{inner: logging.NewLogBackend(os.Stderr, "", 0)}
+
+func init() {
+	logging.SetBackend(testLog)
+}
+
+func (b *testBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inner.Log(level, calldepth+1, rec)
+}
+
+// use sends the log to backend until the test ends.
+func (b *testBackend) use(t *testing.T, backend logging.Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.inner
+	b.inner = backend
+	t.Cleanup(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.inner = previous
+	})
+}
+
+// lockedBuffer is a buffer the log can be written to while it is read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the log to a buffer in the given format until the test
+// ends.
+func captureLog(t *testing.T, formatter logging.Formatter) *lockedBuffer {
+	buf := &lockedBuffer{}
+	testLog.use(t, logging.NewBackendFormatter(logging.NewLogBackend(buf, "", 0), formatter))
+	return buf
+}
+
+func TestJSONLog(t *testing.T) {
+	buf := captureLog(t, jsonFormatter{})
+	logFields{Route: "abc", Frontend: "/app", Error: "connection refused"}.Warningf("Backend %s failed", "b")
+	log.Infof("Plain %d", 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"level":    "WARNING",
+		"message":  "Backend b failed",
+		"route":    "abc",
+		"frontend": "/app",
+		"error":    "connection refused",
+	} {
+		if entry[key] != value {
+			t.Errorf("%s was %q, expected %q", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["remote"]; ok {
+		t.Error("Empty fields were logged", lines[0])
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry["message"] != "Plain 1" {
+		t.Error("Message without fields was logged as", lines[1])
+	}
+}
+
+func TestTextLog(t *testing.T) {
+	buf := captureLog(t, textFormatter{logging.MustStringFormatter("%{level} %{message}")})
+	logFields{Route: "abc", Error: "connection refused"}.Errorf("Backend failed")
+	if line := strings.TrimSpace(buf.String()); line != `ERROR Backend failed route=abc error="connection refused"` {
+		t.Error("Logged", line)
+	}
+}
+
+func TestLogNoSecrets(t *testing.T) {
+	buf := captureLog(t, jsonFormatter{})
+	proxy, _, route := proxyTest(t, http.NotFoundHandler())
+	for _, path := range []string{"/gxproxy/app/", "/gxproxy/missing", "/elsewhere?api_key=secret"} {
+		res, err := http.DefaultClient.Do(proxyRequest(proxy, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	logFields{}.request(proxyRequest(proxy, "/")).Infof("")
+	if strings.Contains(buf.String(), route.AuthorizedCookie) || strings.Contains(buf.String(), "secret") {
+		t.Error("Secrets were logged", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"request_id":"`) {
+		t.Error("Requests were logged without an ID", buf.String())
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+	backend, err := newLogBackend(logJSON, "info", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLog.use(t, backend)
+	if _, err := newLogBackend("xml", "info", ""); err == nil {
+		t.Error("Unknown log format was accepted")
+	}
+	if _, err := newLogBackend(logText, "chatty", ""); err == nil {
+		t.Error("Unknown log level was accepted")
+	}
+
+	log.Debugf("Not logged")
+	log.Infof("Logged")
+	logged, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(logged), "Logged") || strings.Contains(string(logged), "Not logged") {
+		t.Error("Log file held", string(logged))
+	}
+
+	// logrotate moves the file away, then has it reopened
+	rotating := filepath.Join(dir, "rotating.log")
+	file, err := openLogFile(rotating)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("before\n"))
+	os.Rename(rotating, rotating+".1")
+	file.Write([]byte("moved\n"))
+	if err := file.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("reopened\n"))
+
+	old, _ := ioutil.ReadFile(rotating + ".1")
+	current, _ := ioutil.ReadFile(rotating)
+	if string(old) != "before\nmoved\n" || string(current) != "reopened\n" {
+		t.Errorf("Rotated log held %q, reopened one %q", old, current)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
 	"os"
 	"time"
 
@@ -18,11 +20,63 @@ func main() {
 			Value: "0.0.0.0:8800",
 			Usage: "address to listen on",
 		},
+		cli.StringFlag{
+			Name:  "apiHost",
+			Usage: "host name Galaxy reaches the API by, which host routes may not cover",
+		},
 		cli.StringFlag{
 			Name:  "listenPath",
 			Value: "/galaxy/gie_proxy",
 			Usage: "path to listen on (for cookies)",
 		},
+		cli.StringFlag{
+			Name:  "logFormat",
+			Value: logText,
+			Usage: "format of the log, text or json",
+		},
+		cli.StringFlag{
+			Name:  "logLevel",
+			Value: "DEBUG",
+			Usage: "least important messages to log: DEBUG, INFO, NOTICE, WARNING, ERROR or CRITICAL",
+		},
+		cli.StringFlag{
+			Name:  "logFile",
+			Usage: "file to log to instead of stderr. Reopened on SIGHUP, for logrotate",
+		},
+		cli.StringFlag{
+			Name:  "accessLog",
+			Usage: "file to record requests to routes in. Reopened on SIGHUP, for logrotate",
+		},
+		cli.StringFlag{
+			Name:  "accessLogFormat",
+			Value: accessCombined,
+			Usage: "format of the access log, combined or json",
+		},
+		cli.StringFlag{
+			Name:  "auditLog",
+			Usage: "file to append every change to the routes to, as JSON lines. Without, only the latest are kept in memory",
+		},
+		cli.StringFlag{
+			Name:  "adminAddr",
+			Usage: "address to serve /metrics on, apart from the proxy. Empty disables it",
+		},
+		cli.StringSliceFlag{
+			Name:  "tlsCert",
+			Usage: "certificate file to serve HTTPS with. Repeat, with --tlsKey, for several certificates chosen by SNI",
+		},
+		cli.StringSliceFlag{
+			Name:  "tlsKey",
+			Usage: "private key file of the --tlsCert in the same position",
+		},
+		cli.BoolFlag{
+			Name:  "tlsSelfSigned",
+			Usage: "serve HTTPS with a generated self-signed certificate, for development",
+		},
+		cli.IntFlag{
+			Name:  "hsts",
+			Value: 31536000,
+			Usage: "seconds browsers should only use HTTPS for, sent when serving HTTPS with --tlsCert. 0 disables",
+		},
 		cli.StringFlag{
 			Name:  "cookieName",
 			Usage: "cookie name",
@@ -31,12 +85,70 @@ func main() {
 		cli.StringFlag{
 			Name:  "storage",
 			Value: "./sessionMap.xml",
-			Usage: "Session map file. Used to (re)store route lists across restarts",
+			Usage: "Where routes are stored across restarts: a session map file, xml://path, a bolt:// database, or redis:// shared by several proxies",
+		},
+		cli.IntFlag{
+			Name:  "storageBackups",
+			Value: 3,
+			Usage: "Number of previous session map file snapshots to keep, and fall back to if the newest is unreadable",
+		},
+		cli.IntFlag{
+			Name:  "probeInterval",
+			Value: 0,
+			Usage: "Seconds between checks whether the backend of a new route is up. 0 (the default) proxies to new routes straight away",
+		},
+		cli.IntFlag{
+			Name:  "startupTimeout",
+			Value: 300,
+			Usage: "Seconds the backend of a new route may take to come up before the route is removed. 0 waits forever",
+		},
+		cli.StringFlag{
+			Name:  "startingPage",
+			Usage: "HTML template shown while the backend of a route starts up, instead of the built-in page",
+		},
+		cli.IntFlag{
+			Name:  "dialAttempts",
+			Value: 3,
+			Usage: "How often connecting to a backend is tried for each request",
+		},
+		cli.IntFlag{
+			Name:  "dialBackoff",
+			Value: 100,
+			Usage: "Milliseconds before retrying to connect to a backend, doubled for every further attempt",
+		},
+		cli.IntFlag{
+			Name:  "breakerFailures",
+			Value: 5,
+			Usage: "Consecutive failures to reach a backend after which requests to it fail straight away for breakerCooldown. 0 disables",
+		},
+		cli.IntFlag{
+			Name:  "breakerWindow",
+			Value: 30,
+			Usage: "Seconds within which failures to reach a backend count as consecutive",
+		},
+		cli.IntFlag{
+			Name:  "breakerCooldown",
+			Value: 10,
+			Usage: "Seconds requests to a failing backend are refused for",
+		},
+		cli.StringFlag{
+			Name:  "deadBackend",
+			Value: removeContainerDead,
+			Usage: "When to remove a route whose backend cannot be reached: never, after-failures (see removeAfter) or container-dead, once its runtime reports a container dead",
+		},
+		cli.IntFlag{
+			Name:  "removeAfter",
+			Value: 10,
+			Usage: "Consecutive failures to reach a backend after which the after-failures policy removes its route",
 		},
 		cli.StringFlag{
 			Name:  "apiKey",
 			Value: "THE_DEFAULT_IS_NOT_SECURE",
-			Usage: "Key to access to the API",
+			Usage: "Key to access to the API, with full access. Ignored when apiKeys is given unless set explicitly",
+		},
+		cli.StringFlag{
+			Name:  "apiKeys",
+			Usage: "JSON file of named, scoped API keys. Reloaded on SIGHUP",
 		},
 		cli.IntFlag{
 			Name:  "noAccess",
@@ -51,45 +163,183 @@ func main() {
 		cli.StringFlag{
 			Name:  "dockerAddr",
 			Value: "unix:///var/run/docker.sock",
-			Usage: "Endpoint at which we can access docker. No TLS Support yet",
+			Usage: "Endpoint at which we can access docker",
+		},
+		cli.StringFlag{
+			Name:  "dockerTLSCert",
+			Usage: "client certificate for a Docker daemon requiring TLS. Defaults to cert.pem in $DOCKER_CERT_PATH",
+		},
+		cli.StringFlag{
+			Name:  "dockerTLSKey",
+			Usage: "key of --dockerTLSCert. Defaults to key.pem in $DOCKER_CERT_PATH",
+		},
+		cli.StringFlag{
+			Name:  "dockerCACert",
+			Usage: "CA to verify the Docker daemon with. Defaults to ca.pem in $DOCKER_CERT_PATH if $DOCKER_TLS_VERIFY is set",
+		},
+		cli.IntFlag{
+			Name:  "stopGrace",
+			Value: 10,
+			Usage: "Seconds a container gets to exit after SIGTERM when its route is removed, before being killed. 0 kills immediately",
+		},
+		cli.BoolFlag{
+			Name:  "removeContainers",
+			Usage: "Remove containers after stopping them",
+		},
+		cli.BoolFlag{
+			Name:  "removeVolumes",
+			Usage: "Also remove the anonymous volumes of removed containers",
+		},
+		cli.StringFlag{
+			Name:  "runtime",
+			Value: runtimeDocker,
+			Usage: "Default container runtime for routes: docker, podman, kubernetes, process or none",
+		},
+		cli.BoolFlag{
+			Name:  "processRuntime",
+			Usage: "Let routes manage local processes by PID, when process is not the default runtime",
+		},
+		cli.StringFlag{
+			Name:  "podmanAddr",
+			Value: "unix:///run/podman/podman.sock",
+			Usage: "Endpoint of podman's Docker compatible API",
+		},
+		cli.StringFlag{
+			Name:  "kubeAPI",
+			Usage: "Kubernetes API server URL. Defaults to the in-cluster address",
+		},
+		cli.StringFlag{
+			Name:  "kubeNamespace",
+			Usage: "Kubernetes namespace of pods given without one. Defaults to the proxy's own namespace",
+		},
+		cli.StringFlag{
+			Name:  "kubeTokenFile",
+			Usage: "File containing the Kubernetes API bearer token. Defaults to the service account token",
+		},
+		cli.StringFlag{
+			Name:  "kubeCAFile",
+			Usage: "CA bundle for the Kubernetes API. Defaults to the service account CA",
 		},
 	}
 
 	app.Action = func(c *cli.Context) {
-		setupLogging()
-		startServer(
-			c.String("storage"),
-			c.String("dockerAddr"),
-			c.String("cookieName"),
-			c.String("listenAddr"),
-			c.String("listenPath"),
-			c.String("apiKey"),
-			c.Int("noAccess"),
-			c.Int("cleanInterval"),
-		)
+		if err := setupLogging(c.String("logFormat"), c.String("logLevel"), c.String("logFile")); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set up logging: %s\n", err)
+			os.Exit(1)
+		}
+		apiKey := c.String("apiKey")
+		if c.String("apiKeys") != "" && !c.IsSet("apiKey") {
+			apiKey = ""
+		}
+		keys, err := newAPIKeyring(c.String("apiKeys"), apiKey)
+		if err != nil {
+			log.Criticalf("Could not load API keys: %s", err)
+			os.Exit(1)
+		}
+		if c.String("apiKeys") != "" {
+			onHangup(func() {
+				if err := keys.Reload(); err != nil {
+					log.Errorf("Could not reload API keys, keeping the old ones: %s", err)
+				}
+			})
+		}
+		if !removalPolicies[c.String("deadBackend")] {
+			log.Criticalf("Unknown deadBackend policy %s", c.String("deadBackend"))
+			os.Exit(1)
+		}
+		runtimes, err := newContainerRuntimes(runtimeConfig{
+			Default:        c.String("runtime"),
+			DockerEndpoint: c.String("dockerAddr"),
+			DockerTLS: dockerTLS{
+				Cert: c.String("dockerTLSCert"),
+				Key:  c.String("dockerTLSKey"),
+				CA:   c.String("dockerCACert"),
+			}.withEnv(os.Getenv),
+			PodmanEndpoint: c.String("podmanAddr"),
+			KubeAPI:        c.String("kubeAPI"),
+			KubeNamespace:  c.String("kubeNamespace"),
+			KubeTokenFile:  c.String("kubeTokenFile"),
+			KubeCAFile:     c.String("kubeCAFile"),
+			AllowProcess:   c.Bool("processRuntime"),
+		})
+		if err != nil {
+			log.Criticalf("Could not set up container runtimes: %s", err)
+			os.Exit(1)
+		}
+
+		// Load up route mapping
+		rm := &RouteMapping{
+			Storage:           c.String("storage"),
+			StorageBackups:    c.Int("storageBackups"),
+			AuthCookieName:    c.String("cookieName"),
+			NoAccessThreshold: time.Second * time.Duration(c.Int("noAccess")),
+			DockerEndpoint:    c.String("dockerAddr"),
+			CleanInterval:     time.Second * time.Duration(c.Int("cleanInterval")),
+			Runtimes:          runtimes,
+			Audit:             newAuditLog(c.String("auditLog")),
+			DefaultRuntime:    c.String("runtime"),
+			Teardown: TeardownPolicy{
+				GracePeriod:   c.Int("stopGrace"),
+				Remove:        c.Bool("removeContainers"),
+				RemoveVolumes: c.Bool("removeVolumes"),
+			},
+			ProbeInterval:  time.Second * time.Duration(c.Int("probeInterval")),
+			StartupTimeout: time.Second * time.Duration(c.Int("startupTimeout")),
+			Failures: FailurePolicy{
+				DialAttempts:    c.Int("dialAttempts"),
+				DialBackoff:     time.Millisecond * time.Duration(c.Int("dialBackoff")),
+				BreakerFailures: c.Int("breakerFailures"),
+				BreakerWindow:   time.Second * time.Duration(c.Int("breakerWindow")),
+				BreakerCooldown: time.Second * time.Duration(c.Int("breakerCooldown")),
+				Removal:         c.String("deadBackend"),
+				RemoveAfter:     c.Int("removeAfter"),
+			},
+		}
+		// Build the frontend
+		f := &frontend{
+			Addr:      c.String("listenAddr"),
+			Path:      c.String("listenPath"),
+			AdminAddr: c.String("adminAddr"),
+			APIHost:   c.String("apiHost"),
+			APIKeys:   keys,
+		}
+		if len(c.StringSlice("tlsCert")) > 0 || c.Bool("tlsSelfSigned") {
+			f.TLS, err = loadCertificates(c.StringSlice("tlsCert"), c.StringSlice("tlsKey"), c.Bool("tlsSelfSigned"))
+			if err != nil {
+				log.Criticalf("Could not load TLS certificates: %s", err)
+				os.Exit(1)
+			}
+			if !c.Bool("tlsSelfSigned") {
+				f.HSTS = time.Second * time.Duration(c.Int("hsts"))
+			}
+		}
+		if c.String("accessLog") != "" {
+			f.AccessLog, err = openAccessLog(c.String("accessLog"), c.String("accessLogFormat"))
+			if err != nil {
+				log.Criticalf("Could not open the access log: %s", err)
+				os.Exit(1)
+			}
+		}
+		if c.String("startingPage") != "" {
+			f.StartingPage, err = template.ParseFiles(c.String("startingPage"))
+			if err != nil {
+				log.Criticalf("Could not load the starting page: %s", err)
+				os.Exit(1)
+			}
+		}
+		startServer(rm, f)
 	}
 	_ = app.Run(os.Args)
 }
 
-func startServer(sessionMap, dockerEndpoint, cookieName, listenAddr, listenPath, apiKey string, noAccessThreshold, cleanInterval int) {
+func startServer(rm *RouteMapping, f *frontend) {
 	log.Info("Starting up")
-	// Load up route mapping
-	rm := &RouteMapping{
-		Storage:           sessionMap,
-		AuthCookieName:    cookieName,
-		NoAccessThreshold: time.Second * time.Duration(noAccessThreshold),
-		DockerEndpoint:    dockerEndpoint,
-		CleanInterval:     time.Second * time.Duration(cleanInterval),
+	if err := InitializeRouteMapper(rm); err != nil {
+		log.Criticalf("Could not restore routes: %s", err)
+		os.Exit(1)
 	}
-	InitializeRouteMapper(rm)
 	rm.Save()
 
-	// Build the frontend
-	f := &frontend{
-		Addr:   listenAddr,
-		Path:   listenPath,
-		APIKey: apiKey,
-	}
 	// Start our proxy
 	log.Info("Starting frontend ...")
 	f.Start(rm)
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyMetrics are the counters kept for the whole process. Those about a
+// single route live in its routeState, so they go away with it.
+type proxyMetrics struct {
+	// Only accessed atomically
+	websockets   int64
+	dialFailures int64
+	expired      int64
+
+	mu              sync.Mutex
+	cleanerRuns     int64
+	cleanerDuration time.Duration
+	// teardownErrors counts failed teardown steps, by step.
+	teardownErrors map[string]int64
+}
+
+var metrics = &proxyMetrics{}
+
+// cleanerRan records how long a run of the cleaner took.
+func (m *proxyMetrics) cleanerRan(d time.Duration) {
+	m.mu.Lock()
+	m.cleanerRuns++
+	m.cleanerDuration += d
+	m.mu.Unlock()
+}
+
+// teardownFailed records a failed step of tearing down a container.
+func (m *proxyMetrics) teardownFailed(step string) {
+	m.mu.Lock()
+	if m.teardownErrors == nil {
+		m.teardownErrors = make(map[string]int64)
+	}
+	m.teardownErrors[step]++
+	m.mu.Unlock()
+}
+
+// routeMetrics are kept for every route, only accessed atomically.
+type routeMetrics struct {
+	requests int64
+	// received from the user, sent to them
+	received int64
+	sent     int64
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+// header introduces a metric.
+func (w metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value of a metric, with labels given as name, value
+// pairs.
+func (w metricsWriter) sample(name string, value interface{}, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=%q", labels[i], labels[i+1])
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", value)
+}
+
+// ServeMetrics writes the metrics of the proxy and its routes. Routes are
+// labelled by ID; their cookies are secrets.
+func (rm *RouteMapping) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	type routeSample struct {
+		id      string
+		metrics *routeMetrics
+	}
+	rm.mu.RLock()
+	routes := make([]routeSample, 0, len(rm.routes))
+	for _, route := range rm.routes {
+		routes = append(routes, routeSample{route.ID, &route.live.metrics})
+	}
+	rm.mu.RUnlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].id < routes[j].id })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := metricsWriter{bufio.NewWriter(w)}
+	defer out.Flush()
+
+	out.header("gie_proxy_routes", "gauge", "Number of routes.")
+	out.sample("gie_proxy_routes", len(routes))
+
+	out.header("gie_proxy_route_requests_total", "counter", "Requests proxied, by route.")
+	for _, route := range routes {
+		out.sample("gie_proxy_route_requests_total", atomic.LoadInt64(&route.metrics.requests), "route", route.id)
+	}
+	out.header("gie_proxy_route_bytes_total", "counter", "Bytes proxied, by route and direction.")
+	for _, route := range routes {
+		out.sample("gie_proxy_route_bytes_total", atomic.LoadInt64(&route.metrics.received), "route", route.id, "direction", "received")
+		out.sample("gie_proxy_route_bytes_total", atomic.LoadInt64(&route.metrics.sent), "route", route.id, "direction", "sent")
+	}
+
+	out.header("gie_proxy_websockets", "gauge", "Open websocket connections.")
+	out.sample("gie_proxy_websockets", atomic.LoadInt64(&metrics.websockets))
+	out.header("gie_proxy_backend_dial_failures_total", "counter", "Failed attempts to connect to a backend.")
+	out.sample("gie_proxy_backend_dial_failures_total", atomic.LoadInt64(&metrics.dialFailures))
+	out.header("gie_proxy_routes_expired_total", "counter", "Routes removed for lack of traffic.")
+	out.sample("gie_proxy_routes_expired_total", atomic.LoadInt64(&metrics.expired))
+
+	metrics.mu.Lock()
+	runs, duration := metrics.cleanerRuns, metrics.cleanerDuration
+	steps := make([]string, 0, len(metrics.teardownErrors))
+	failed := make(map[string]int64, len(metrics.teardownErrors))
+	for step, n := range metrics.teardownErrors {
+		steps = append(steps, step)
+		failed[step] = n
+	}
+	metrics.mu.Unlock()
+	sort.Strings(steps)
+
+	out.header("gie_proxy_cleaner_duration_seconds", "summary", "Time taken by runs of the cleaner.")
+	out.sample("gie_proxy_cleaner_duration_seconds_sum", duration.Seconds())
+	out.sample("gie_proxy_cleaner_duration_seconds_count", runs)
+	out.header("gie_proxy_container_errors_total", "counter", "Failed steps of container teardowns, such as kill.")
+	for _, step := range steps {
+		out.sample("gie_proxy_container_errors_total", failed[step], "step", step)
+	}
+}
+
+// adminHandler serves the endpoints meant for operators rather than users.
+func (f *frontend) adminHandler(rm *RouteMapping) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", rm.ServeMetrics)
+	f.handleHealth(mux, rm)
+	return mux
+}
+
+// startAdmin serves the admin endpoints on their own listener, so they need
+// not be exposed with the proxy.
+func startAdmin(addr string, handler http.Handler) {
+	log.Infof("Admin endpoints listening on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Criticalf("Starting admin listener failed: %v", err)
+		}
+	}()
+}
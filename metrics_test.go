@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	proxy, rm, route := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", proxy.URL+"/gxproxy/app/", strings.NewReader("hello"))
+		req.AddCookie(&http.Cookie{Name: "sid", Value: "user"})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	metrics.teardownFailed("kill")
+
+	admin := httptest.NewServer((&frontend{}).adminHandler(rm))
+	defer admin.Close()
+	res, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	text := string(body)
+
+	for _, sample := range []string{
+		"gie_proxy_routes 1\n",
+		fmt.Sprintf("gie_proxy_route_requests_total{route=%q} 3\n", route.ID),
+		fmt.Sprintf("gie_proxy_route_bytes_total{route=%q,direction=\"received\"} 15\n", route.ID),
+		fmt.Sprintf("gie_proxy_route_bytes_total{route=%q,direction=\"sent\"} 15\n", route.ID),
+		"# TYPE gie_proxy_cleaner_duration_seconds summary\n",
+		"gie_proxy_container_errors_total{step=\"kill\"} ",
+	} {
+		if !strings.Contains(text, sample) {
+			t.Errorf("Metrics lack %q:\n%s", sample, text)
+		}
+	}
+	if strings.Contains(text, route.AuthorizedCookie) {
+		t.Error("Metrics leak the route's cookie")
+	}
+}
@@ -1,62 +1,110 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 )
 
-func connectRoute(h *requestHandler, w http.ResponseWriter, r *http.Request, route **Route) error {
+func connectRoute(h *requestHandler, w http.ResponseWriter, r *http.Request, route **Route, transport *http.Transport) error {
 	var err error
 	if shouldUpgradeWebsocket(r) {
-		err = plumbWebsocket(w, r, route)
+		// Add x-forwarded-for header, the reverse proxy does so itself
+		addForwardedFor(r)
+		h.rewriteRequest(*route, r)
+		err = plumbWebsocket(transport, w, r, route)
 	} else {
-		err = plumbHTTP(h, w, r, route)
+		err = plumbHTTP(h, transport, w, r, route)
 	}
 	return err
 }
 
 func (h *requestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r.URL.Scheme = "http"
-	// Add x-forwarded-for header
-	addForwardedFor(r)
-
-	// Their requested URL must agree with our prefix
-	if !strings.HasPrefix(r.RequestURI, h.Frontend.Path) {
-		log.Warning("Bad request %s", r.RequestURI)
-		http.Error(w, "unknown backend", http.StatusBadRequest)
-		return
+	setRequestID(r)
+	fields := logFields{}.request(r)
+	access := h.Frontend.AccessLog.begin(w, r)
+	if access != nil {
+		defer access.finish()
+		w = access
 	}
 
 	// Get their cookie
-	cookie, err := r.Cookie(h.RouteMapping.AuthCookieName)
-	if err != nil {
-		log.Warning("Request lacked cookie")
-		http.Error(w, "unknown auth cookie", http.StatusUnauthorized)
-		return
+	cookie, cookieErr := r.Cookie(h.RouteMapping.AuthCookieName)
+
+	// Routes for the requested host are served at its root, anything else
+	// must be under our prefix
+	var route *Route
+	err := errRouteNotFound
+	if cookieErr == nil {
+		route, err = h.RouteMapping.FindHostRoute(r.Host, r.RequestURI, cookie.Value)
 	}
+	if err == errRouteNotFound {
+		// Their requested URL must agree with our prefix
+		if !strings.HasPrefix(r.RequestURI, h.Frontend.Path) {
+			fields.Warningf("Bad request for %s", r.URL.Path)
+			http.Error(w, "unknown backend", http.StatusBadRequest)
+			return
+		}
+		if cookieErr != nil {
+			fields.Warningf("Request lacked cookie")
+			http.Error(w, "unknown auth cookie", http.StatusUnauthorized)
+			return
+		}
 
-	// Find our route
-	route, err := h.RouteMapping.FindRoute(
-		r.RequestURI[len(h.Frontend.Path):], // Strip proxy prefix from path
-		cookie.Value,
-	)
-	if err != nil && err.Error() == "Could not find route" {
-		log.Warning("Could not find route")
+		// Find our route
+		route, err = h.RouteMapping.FindRoute(
+			r.RequestURI[len(h.Frontend.Path):], // Strip proxy prefix from path
+			cookie.Value,
+		)
+	}
+	if err == errRouteNotFound {
+		fields.Warningf("Could not find route")
 		http.Error(w, "unknown backend", http.StatusBadRequest)
+		return
+	}
+	if !route.IsReady() {
+		serveStarting(h.Frontend, w, r)
+		return
+	}
+	if !h.RouteMapping.backendAvailable(route) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(h.RouteMapping.Failures.BreakerCooldown.Seconds())))
+		http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddInt64(&route.live.metrics.requests, 1)
+	if r.Body != nil {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &route.live.metrics.received}
+	}
+	backend, release := h.RouteMapping.pickBackend(route, cookie.Value, shouldUpgradeWebsocket(r))
+	defer release()
+	access.target(route, backend)
+	transport, err := h.backendTransport(route, backend, r)
+	if err != nil {
+		routeFields(route).request(r).backend(backend).err(err).Errorf("Could not set up the connection to the backend")
+		http.Error(w, "backend misconfigured", http.StatusBadGateway)
+		return
 	}
 	// Reset request URI
 	r.RequestURI = ""
-	r.URL.Host = route.BackendAddr
-	// Strip frontend's path out
-	//r.URL.Path = r.URL.Path[len(h.Frontend.Path):]
+	// Backends are mostly spoken to over plain HTTP, but should build
+	// https:// URLs when the user is on HTTPS. What clients claim does not
+	// count.
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
 
 	// Here we do the plumbing and connect up goroutines to automatically
 	// copy between two endpoints
-	connectErr := connectRoute(h, w, r, &route)
+	connectErr := connectRoute(h, w, r, &route, transport)
 
-	// If the backend is dead, remove it.
-	// The next request from the user will be better behaved.
-	if connectErr != nil && connectErr.Error() == "dead-backend" {
-		h.RouteMapping.RemoveRoute(route)
+	// If the backend is dead, the failure policy decides whether to remove
+	// it. The next request from the user will be better behaved.
+	if connectErr == errDeadBackend {
+		h.RouteMapping.backendFailed(route, backend)
+	} else if connectErr == nil {
+		h.RouteMapping.backendSucceeded(route, backend)
 	}
 }
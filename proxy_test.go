@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// proxyTest sets up a proxy in front of backend, with a single route to it
+// for the cookie "sid=user".
+func proxyTest(t *testing.T, backend http.Handler) (*httptest.Server, *RouteMapping, *Route) {
+	ts := httptest.NewServer(backend)
+	t.Cleanup(ts.Close)
+	rm := &RouteMapping{AuthCookieName: "sid"}
+	route := rm.AddRoute("test", Route{FrontendPath: "/app", BackendAddr: ts.Listener.Addr().String(), AuthorizedCookie: "user"})
+	proxy := httptest.NewServer(&requestHandler{
+		Transport:    &http.Transport{},
+		RouteMapping: rm,
+		Frontend:     &frontend{Path: "/gxproxy"},
+	})
+	t.Cleanup(proxy.Close)
+	return proxy, rm, route
+}
+
+func proxyRequest(proxy *httptest.Server, path string) *http.Request {
+	req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "user"})
+	return req
+}
+
+func TestPlumbHTTPStreaming(t *testing.T) {
+	next := make(chan bool)
+	proxy, _, route := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body := bufio.NewReader(res.Body)
+	for i := 0; i < 3; i++ {
+		// Each event must arrive before the backend sends the next one
+		received := make(chan string)
+		go func() {
+			line, _ := body.ReadString('\n')
+			_, _ = body.ReadString('\n')
+			received <- line
+		}()
+		select {
+		case line := <-received:
+			if line != fmt.Sprintf("data: %d\n", i) {
+				t.Error("Received", line, "as event", i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Event", i, "was not flushed to the client")
+		}
+		if i > 0 && route.LastAccess().UnixNano() == 0 {
+			t.Error("Streaming did not mark the route as seen")
+		}
+		atomic.StoreInt64(&route.live.seen, 0)
+		next <- true
+	}
+}
+
+func TestPlumbHTTPHeaders(t *testing.T) {
+	proxy, _, _ := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Hop") != "" || r.Header.Get("Keep-Alive") != "" {
+			t.Error("Hop-by-hop request headers were forwarded", r.Header)
+		}
+		if xff := r.Header["X-Forwarded-For"]; len(xff) != 1 || xff[0] != "127.0.0.1" {
+			t.Error("Expected a single X-Forwarded-For, found", xff)
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "http" {
+			t.Error("Plain HTTP was forwarded as", proto)
+		}
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		if strings.HasSuffix(r.URL.Path, "/fixed") {
+			w.Header().Set("Content-Length", "5")
+			fmt.Fprint(w, "hello")
+			return
+		}
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "hello")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/fixed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.ContentLength != 5 {
+		t.Error("Content-Length was not kept, found", res.ContentLength)
+	}
+
+	req := proxyRequest(proxy, "/gxproxy/app/")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "hello" {
+		t.Error("Unexpected body", string(body))
+	}
+	if res.Header.Get("X-Backend-Hop") != "" {
+		t.Error("Hop-by-hop response header was forwarded")
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" {
+		t.Error("Trailer was not forwarded", res.Trailer)
+	}
+}
+
+func TestPlumbHTTPDeadBackend(t *testing.T) {
+	proxy, rm, route := proxyTest(t, http.NotFoundHandler())
+	// Nothing listens at a port we just closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	dead, err := rm.UpdateRoute("test", route.ID, Route{FrontendPath: "/app", BackendAddr: l.Addr().String(), AuthorizedCookie: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected 503 from a dead backend, got", res.StatusCode)
+	}
+	if _, err := rm.GetRoute(dead.ID); err == nil {
+		t.Error("Route to a dead backend was kept")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import "sort"
+
+// radixTree is a compressed prefix tree keyed on FrontendPath. It answers
+// "which registered path is the longest prefix of this URL" in time
+// proportional to the URL length, independent of the number of routes.
+//
+// It is not safe for concurrent use; RouteMapping guards it with its lock.
+type radixTree struct {
+	root radixNode
+	size int
+}
+
+type radixNode struct {
+	// prefix is the edge label leading into this node.
+	prefix string
+	// route is set if a key terminates at this node.
+	route *Route
+	// children are sorted by the first byte of their prefix, which is unique
+	// amongst siblings.
+	children []*radixNode
+}
+
+// Len returns the number of keys stored in the tree.
+func (t *radixTree) Len() int {
+	return t.size
+}
+
+// Get returns the route stored under exactly key, or nil.
+func (t *radixTree) Get(key string) *Route {
+	n := &t.root
+	for {
+		if key == "" {
+			return n.route
+		}
+		child := n.child(key[0])
+		if child == nil || len(key) < len(child.prefix) || key[:len(child.prefix)] != child.prefix {
+			return nil
+		}
+		key = key[len(child.prefix):]
+		n = child
+	}
+}
+
+// Insert stores route under key, returning the route previously stored there
+// if any.
+func (t *radixTree) Insert(key string, route *Route) *Route {
+	n := &t.root
+	for {
+		if key == "" {
+			old := n.route
+			n.route = route
+			if old == nil {
+				t.size++
+			}
+			return old
+		}
+
+		idx := n.childIndex(key[0])
+		if idx == len(n.children) || n.children[idx].prefix[0] != key[0] {
+			// No edge shares a first byte with key, add a new leaf.
+			leaf := &radixNode{prefix: key, route: route}
+			n.children = append(n.children, nil)
+			copy(n.children[idx+1:], n.children[idx:])
+			n.children[idx] = leaf
+			t.size++
+			return nil
+		}
+
+		child := n.children[idx]
+		common := commonPrefixLen(key, child.prefix)
+		if common < len(child.prefix) {
+			// Split the edge at the point where key diverges.
+			split := &radixNode{
+				prefix:   child.prefix[:common],
+				children: []*radixNode{child},
+			}
+			child.prefix = child.prefix[common:]
+			n.children[idx] = split
+			child = split
+		}
+		key = key[common:]
+		n = child
+	}
+}
+
+// Delete removes key from the tree, returning the route that was stored
+// there, if any.
+func (t *radixTree) Delete(key string) *Route {
+	var parent *radixNode
+	n := &t.root
+	for key != "" {
+		child := n.child(key[0])
+		if child == nil || len(key) < len(child.prefix) || key[:len(child.prefix)] != child.prefix {
+			return nil
+		}
+		key = key[len(child.prefix):]
+		parent, n = n, child
+	}
+	old := n.route
+	if old == nil {
+		return nil
+	}
+	n.route = nil
+	t.size--
+
+	if parent == nil {
+		// Never prune the root.
+		return old
+	}
+	switch len(n.children) {
+	case 0:
+		parent.removeChild(n.prefix[0])
+		// The parent may now be a pass-through node that can be merged.
+		if parent != &t.root && parent.route == nil && len(parent.children) == 1 {
+			parent.mergeChild()
+		}
+	case 1:
+		n.mergeChild()
+	}
+	return old
+}
+
+// LongestPrefix returns the route whose key is the longest prefix of s, or
+// nil if no key is a prefix of s.
+func (t *radixTree) LongestPrefix(s string) *Route {
+	n := &t.root
+	match := n.route
+	for s != "" {
+		child := n.child(s[0])
+		if child == nil || len(s) < len(child.prefix) || s[:len(child.prefix)] != child.prefix {
+			break
+		}
+		s = s[len(child.prefix):]
+		n = child
+		if n.route != nil {
+			match = n.route
+		}
+	}
+	return match
+}
+
+func (n *radixNode) childIndex(b byte) int {
+	return sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= b
+	})
+}
+
+func (n *radixNode) child(b byte) *radixNode {
+	idx := n.childIndex(b)
+	if idx < len(n.children) && n.children[idx].prefix[0] == b {
+		return n.children[idx]
+	}
+	return nil
+}
+
+func (n *radixNode) removeChild(b byte) {
+	idx := n.childIndex(b)
+	if idx < len(n.children) && n.children[idx].prefix[0] == b {
+		n.children = append(n.children[:idx], n.children[idx+1:]...)
+	}
+}
+
+// mergeChild folds a node's only child into it.
+func (n *radixNode) mergeChild() {
+	child := n.children[0]
+	n.prefix += child.prefix
+	n.route = child.route
+	n.children = child.children
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestRadixTree(t *testing.T) {
+	tree := &radixTree{}
+	routes := make(map[string]*Route)
+	keys := []string{"/ipython", "/ipython/1", "/ipython/12", "/rstudio", "/r", "", "/ipython/2/x"}
+	for _, key := range keys {
+		routes[key] = &Route{FrontendPath: key}
+		if old := tree.Insert(key, routes[key]); old != nil {
+			t.Error("Unexpected displaced route for", key)
+		}
+	}
+	if tree.Len() != len(keys) {
+		t.Error("Expected", len(keys), "keys, found", tree.Len())
+	}
+
+	type testcase struct {
+		URL      string
+		Expected string
+	}
+	tests := []testcase{
+		{"/ipython/12/api/kernels", "/ipython/12"},
+		{"/ipython/1/api", "/ipython/1"},
+		{"/ipython/13", "/ipython/1"},
+		{"/ipython/2/y", "/ipython"},
+		{"/ipython/2/x", "/ipython/2/x"},
+		{"/rstudio/session", "/rstudio"},
+		{"/rs", "/r"},
+		{"/other", ""},
+	}
+	for _, tc := range tests {
+		if found := tree.LongestPrefix(tc.URL); found != routes[tc.Expected] {
+			t.Error("For", tc.URL, "expected", tc.Expected, "found", found)
+		}
+	}
+
+	replacement := &Route{FrontendPath: "/ipython/1"}
+	if old := tree.Insert("/ipython/1", replacement); old != routes["/ipython/1"] {
+		t.Error("Insert did not return displaced route")
+	}
+	if tree.Get("/ipython/1") != replacement {
+		t.Error("Insert did not replace route")
+	}
+
+	for _, key := range []string{"/ipython/1", "", "/r"} {
+		if tree.Delete(key) == nil {
+			t.Error("Could not delete", key)
+		}
+	}
+	if tree.Delete("/ipython/") != nil {
+		t.Error("Deleted a key which was never inserted")
+	}
+	if found := tree.LongestPrefix("/ipython/13"); found != routes["/ipython"] {
+		t.Error("After delete, expected /ipython found", found)
+	}
+	if found := tree.LongestPrefix("/rs"); found != nil {
+		t.Error("After delete, expected no match found", found)
+	}
+	if tree.Get("/ipython/12") != routes["/ipython/12"] || tree.Get("/rstudio") != routes["/rstudio"] {
+		t.Error("Delete lost unrelated keys")
+	}
+	if tree.Len() != len(keys)-3 {
+		t.Error("Expected", len(keys)-3, "keys, found", tree.Len())
+	}
+}
+
+func TestRadixTreeMatchesScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := "/ab1"
+	randomPath := func() string {
+		b := make([]byte, rng.Intn(8))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	tree := &radixTree{}
+	present := make(map[string]*Route)
+	for i := 0; i < 5000; i++ {
+		key := randomPath()
+		if rng.Intn(3) == 0 {
+			if (tree.Delete(key) != nil) != (present[key] != nil) {
+				t.Fatal("Delete disagrees with reference for", key)
+			}
+			delete(present, key)
+		} else {
+			route := &Route{FrontendPath: key}
+			tree.Insert(key, route)
+			present[key] = route
+		}
+
+		url := randomPath() + randomPath()
+		var expected *Route
+		for key, route := range present {
+			if strings.HasPrefix(url, key) && (expected == nil || len(key) > len(expected.FrontendPath)) {
+				expected = route
+			}
+		}
+		if found := tree.LongestPrefix(url); found != expected {
+			t.Fatal("For", url, "expected", expected, "found", found)
+		}
+		if tree.Len() != len(present) {
+			t.Fatal("Expected", len(present), "keys, found", tree.Len())
+		}
+	}
+}
+
+// scanFindRoute is the linear scan FindRoute used before routes were
+// indexed, kept as a benchmark baseline.
+func scanFindRoute(routes []*Route, url string, cookie string) *Route {
+	for _, route := range routes {
+		if strings.HasPrefix(url, route.FrontendPath) && route.IsAuthorized(cookie) {
+			return route
+		}
+	}
+	return nil
+}
+
+func benchmarkRouteMapping(n int) (*RouteMapping, []string, []string) {
+	routes := make([]Route, 0, n)
+	urls := make([]string, 0, n)
+	cookies := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		cookie := fmt.Sprintf("session-%08d", i)
+		path := fmt.Sprintf("/ipython/%08x", i*2654435761)
+		routes = append(routes, Route{FrontendPath: path, BackendAddr: "127.0.0.1:8888", AuthorizedCookie: cookie})
+		urls = append(urls, path+"/api/kernels/1234/channels")
+		cookies = append(cookies, cookie)
+	}
+	rm := &RouteMapping{}
+	rm.setRoutes(routes)
+	return rm, urls, cookies
+}
+
+func benchmarkFindRoute(b *testing.B, n int) {
+	rm, urls, cookies := benchmarkRouteMapping(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rm.FindRoute(urls[i%n], cookies[i%n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkScanFindRoute(b *testing.B, n int) {
+	rm, urls, cookies := benchmarkRouteMapping(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rm.mu.RLock()
+		route := scanFindRoute(rm.routes, urls[i%n], cookies[i%n])
+		rm.mu.RUnlock()
+		if route == nil {
+			b.Fatal("Could not find route")
+		}
+	}
+}
+
+func BenchmarkFindRoute10(b *testing.B)        { benchmarkFindRoute(b, 10) }
+func BenchmarkFindRoute1000(b *testing.B)      { benchmarkFindRoute(b, 1000) }
+func BenchmarkFindRoute10000(b *testing.B)     { benchmarkFindRoute(b, 10000) }
+func BenchmarkScanFindRoute10(b *testing.B)    { benchmarkScanFindRoute(b, 10) }
+func BenchmarkScanFindRoute1000(b *testing.B)  { benchmarkScanFindRoute(b, 1000) }
+func BenchmarkScanFindRoute10000(b *testing.B) { benchmarkScanFindRoute(b, 10000) }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Route states
+const (
+	// routePending routes wait for their backend to come up, meanwhile
+	// users are shown a page asking them to wait.
+	routePending = "pending"
+	// routeReady routes are proxied to their backend.
+	routeReady = "ready"
+)
+
+// startingRefresh is how often, in seconds, the starting page reloads.
+const startingRefresh = 3
+
+// defaultStartingPage is shown while the backend of a route starts up, unless
+// the frontend has its own.
+var defaultStartingPage = template.Must(template.New("starting").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Starting</title>
+</head>
+<body>
+<p>Your environment is starting, this page reloads by itself once it is ready.</p>
+</body>
+</html>
+`))
+
+// startingPageData is passed to the starting page template.
+type startingPageData struct {
+	// Path is the requested path.
+	Path string
+	// Refresh is the number of seconds until the page reloads.
+	Refresh int
+}
+
+// IsReady reports whether the route's backend is up. Routes which have not
+// been added anywhere go by their State.
+func (r *Route) IsReady() bool {
+	if r.live == nil {
+		return r.State != routePending
+	}
+	return atomic.LoadInt32(&r.live.ready) == 1
+}
+
+// state returns the current State of the route.
+func (r *Route) state() string {
+	if r.IsReady() {
+		return routeReady
+	}
+	return routePending
+}
+
+// setReady marks the route ready, returning false if it already was.
+func (s *routeState) setReady() bool {
+	return atomic.CompareAndSwapInt32(&s.ready, 0, 1)
+}
+
+// probeBackends checks once whether any of a route's backends answers.
+func probeBackends(route *Route, timeout time.Duration) error {
+	var err error
+	for _, addr := range route.backendAddrs() {
+		if err = probeBackend(addr, route.BackendTLS, route.HealthPath, timeout); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probeBackend checks once whether a backend answers: with a GET of
+// healthPath if there is one, otherwise by opening a connection to it.
+func probeBackend(addr string, c *BackendTLS, healthPath string, timeout time.Duration) error {
+	target := parseBackend(addr)
+	if healthPath == "" {
+		network, address := "tcp", target.host
+		if target.socket != "" {
+			network, address = "unix", target.socket
+		}
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	transport, err := newBackendTransport(&http.Transport{}, target, c)
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// A redirect is an answer
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	health := &url.URL{Scheme: target.scheme, Host: target.host, Path: healthPath}
+	resp, err := client.Get(health.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// startProbe waits for the backend of a pending route in the background,
+// marking the route ready once it answers, or removing it if it has not
+// after StartupTimeout.
+func (rm *RouteMapping) startProbe(route *Route) {
+	if route.IsReady() {
+		return
+	}
+	go rm.probe(route)
+}
+
+// probePending resumes waiting for the backends of routes which were still
+// pending when they were stored.
+func (rm *RouteMapping) probePending() {
+	var pending []*Route
+	rm.mu.RLock()
+	for _, route := range rm.routes {
+		if !route.IsReady() {
+			pending = append(pending, route)
+		}
+	}
+	rm.mu.RUnlock()
+
+	for _, route := range pending {
+		rm.waitForBackend(route)
+	}
+}
+
+// waitForBackend probes the backend of a pending route in the background, or
+// marks the route ready straight away if probing is disabled.
+func (rm *RouteMapping) waitForBackend(route *Route) {
+	if rm.ProbeInterval > 0 {
+		rm.startProbe(route)
+	} else {
+		rm.markReady(route)
+	}
+}
+
+func (rm *RouteMapping) probe(route *Route) {
+	deadline := time.Now().Add(rm.StartupTimeout)
+	ticker := time.NewTicker(rm.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		// Follow updates to the route, and stop once it is gone
+		current, err := rm.GetRoute(route.ID)
+		if err != nil || current.live != route.live || current.IsReady() {
+			return
+		}
+		err = probeBackends(current, rm.ProbeInterval)
+		if err == nil {
+			rm.markReady(current)
+			return
+		}
+		if rm.StartupTimeout > 0 && time.Now().After(deadline) {
+			routeFields(current).err(err).Warningf("Backend did not come up")
+			rm.RemoveRoute(actorStartup, current, fmt.Sprintf("backend not ready after %s", rm.StartupTimeout))
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// markReady switches a route to ready and stores the change. Its inactivity
+// is counted from now on.
+func (rm *RouteMapping) markReady(route *Route) {
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+	if !route.live.setReady() {
+		return
+	}
+	route.Seen()
+	routeFields(route).Infof("Backend is ready")
+	if current, err := rm.GetRoute(route.ID); err == nil && current.live == route.live {
+		rm.persist([]*Route{current}, nil)
+	}
+}
+
+// serveStarting shows the starting page for a pending route.
+func serveStarting(f *frontend, w http.ResponseWriter, r *http.Request) {
+	page := f.StartingPage
+	if page == nil {
+		page = defaultStartingPage
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", fmt.Sprint(startingRefresh))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := page.Execute(w, startingPageData{
+		Path:    r.URL.Path,
+		Refresh: startingRefresh,
+	})
+	if err != nil {
+		log.Warningf("Could not render the starting page: %s", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeBackend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if err := probeBackend(addr, nil, "", time.Second); err != nil {
+		t.Error("Listening backend failed the TCP probe", err)
+	}
+	l.Close()
+	if err := probeBackend(addr, nil, "", time.Second); err == nil {
+		t.Error("Closed backend passed the TCP probe")
+	}
+}
+
+func TestReadinessGating(t *testing.T) {
+	var up int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/health") && atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	rm := &RouteMapping{
+		AuthCookieName: "sid",
+		ProbeInterval:  10 * time.Millisecond,
+		StartupTimeout: time.Minute,
+	}
+	proxy := httptest.NewServer(&requestHandler{
+		Transport:    &http.Transport{},
+		RouteMapping: rm,
+		Frontend:     &frontend{Path: "/gxproxy"},
+	})
+	defer proxy.Close()
+	route := rm.AddRoute("test", Route{
+		FrontendPath:     "/app",
+		BackendAddr:      backend.Listener.Addr().String(),
+		AuthorizedCookie: "user",
+		HealthPath:       "/health",
+	})
+	if snapshot := route.snapshot(); snapshot.State != routePending {
+		t.Error("New route is", snapshot.State)
+	}
+
+	fetch := func() (int, string) {
+		res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	code, body := fetch()
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, `http-equiv="refresh"`) {
+		t.Error("Expected the starting page, got", code, body)
+	}
+
+	atomic.StoreInt32(&up, 1)
+	eventually(t, "the route to become ready", route.IsReady)
+	if code, body := fetch(); code != http.StatusOK || body != "backend" {
+		t.Error("Ready route was not proxied, got", code, body)
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	rt := &recordingRuntime{}
+	rm := &RouteMapping{
+		ProbeInterval:  10 * time.Millisecond,
+		StartupTimeout: 50 * time.Millisecond,
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: rt},
+		DefaultRuntime: runtimeDocker,
+	}
+	route := rm.AddRoute("test", Route{FrontendPath: "/app", BackendAddr: l.Addr().String(), AuthorizedCookie: "user", ContainerIds: []string{"slow"}})
+	eventually(t, "the route to time out", func() bool {
+		return rm.Len() == 0
+	})
+	rm.WaitTeardowns()
+
+	removals := rm.Removals()
+	if len(removals) != 1 || removals[0].Route.ID != route.ID || !strings.Contains(removals[0].Reason, "not ready") {
+		t.Error("Timeout was not recorded", removals)
+	}
+	if len(rt.killed) != 1 || rt.killed[0] != "slow" {
+		t.Error("Expected the container to be killed, found", rt.killed)
+	}
+}
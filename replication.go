@@ -0,0 +1,173 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Route change operations, as published to other proxies
+const (
+	routeChangePut    = "put"
+	routeChangeDelete = "delete"
+	// routeChangeSync is sent whenever changes may have been missed, the
+	// routes should then be reloaded from the store.
+	routeChangeSync = "sync"
+)
+
+// routeChange is a change to the routes made by another proxy sharing the
+// store.
+type routeChange struct {
+	// Origin identifies the proxy which made the change.
+	Origin string
+	Op     string
+	Route  *Route `json:",omitempty"`
+	ID     string `json:",omitempty"`
+}
+
+// routeWatcher is implemented by stores shared between several proxies,
+// which report the changes the others make.
+type routeWatcher interface {
+	// WatchRoutes calls fn for every change made by another proxy, in the
+	// background, until the store is closed.
+	WatchRoutes(fn func(change routeChange)) error
+}
+
+// leaser is implemented by stores shared between several proxies, to elect
+// the one whose cleaner removes expired routes and kills their containers.
+type leaser interface {
+	HoldsLease() bool
+}
+
+// WatchStore follows the changes other proxies make to the store, if it is
+// shared with any.
+func (rm *RouteMapping) WatchStore() error {
+	watcher, ok := rm.Store.(routeWatcher)
+	if !ok {
+		return nil
+	}
+	return watcher.WatchRoutes(rm.applyChange)
+}
+
+// holdsCleanerLease reports whether this proxy's cleaner should remove
+// expired routes. Of several proxies sharing a store only one does.
+func (rm *RouteMapping) holdsCleanerLease() bool {
+	l, ok := rm.Store.(leaser)
+	return !ok || l.HoldsLease()
+}
+
+// applyChange brings the mapping in line with a change another proxy made to
+// the store. Nothing is written back, and the containers of removed routes
+// are left to the proxy which removed them.
+func (rm *RouteMapping) applyChange(change routeChange) {
+	// Backends of new pending routes are waited for here as well, in case
+	// the proxy which added them goes away
+	var pending []*Route
+	defer func() {
+		for _, route := range pending {
+			rm.waitForBackend(route)
+		}
+	}()
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+
+	switch change.Op {
+	case routeChangePut:
+		if change.Route == nil {
+			return
+		}
+		rm.mu.Lock()
+		rm.initLocked()
+		if added := rm.applyPutLocked(*change.Route); added != nil && !added.IsReady() {
+			pending = append(pending, added)
+		}
+		rm.mu.Unlock()
+	case routeChangeDelete:
+		rm.mu.Lock()
+		rm.applyDeleteLocked(change.ID)
+		rm.mu.Unlock()
+	case routeChangeSync:
+		// Loaded under storeMu, so every local change is included
+		routes, err := rm.Store.Load()
+		if err != nil {
+			log.Warningf("Could not reload routes from storage: %s", err)
+			return
+		}
+		present := make(map[string]bool)
+		rm.mu.Lock()
+		rm.initLocked()
+		for _, route := range routes {
+			present[route.ID] = true
+			if added := rm.applyPutLocked(route); added != nil && !added.IsReady() {
+				pending = append(pending, added)
+			}
+		}
+		for id := range rm.byID {
+			if !present[id] {
+				rm.applyDeleteLocked(id)
+			}
+		}
+		rm.mu.Unlock()
+	}
+}
+
+// applyPutLocked adds or updates a route as stored by another proxy,
+// returning it if it was not known here yet. If only its LastSeen differs,
+// the newer of the two is kept. The caller must hold rm.mu for writing.
+func (rm *RouteMapping) applyPutLocked(route Route) *Route {
+	seen := route.LastSeen.UnixNano()
+	current := rm.byID[route.ID]
+	if current != nil && sameDefinition(current.snapshot(), route) {
+		current.live.observe(seen)
+		return nil
+	}
+
+	// Whatever the other proxy displaced is gone from the store as well
+	if other := rm.lookupLocked(route.AuthorizedCookie, route.indexKey()); other != nil && other != current {
+		rm.deleteLocked(other)
+	}
+	next := &route
+	if current != nil {
+		next.live = current.live
+		next.live.observe(seen)
+		if route.State != routePending {
+			next.live.setReady()
+		}
+		rm.replaceLocked(current, next)
+		return nil
+	}
+	next.activate()
+	rm.insertLocked(next)
+	return next
+}
+
+// applyDeleteLocked drops a route removed by another proxy. The caller must
+// hold rm.mu for writing.
+func (rm *RouteMapping) applyDeleteLocked(id string) {
+	if route, ok := rm.byID[id]; ok {
+		rm.deleteLocked(route)
+		rm.retireLocked(route, "removed by another proxy")
+	}
+}
+
+// sameDefinition compares two routes ignoring their activity.
+func sameDefinition(a, b Route) bool {
+	a.LastSeen, b.LastSeen = time.Time{}, time.Time{}
+	a.live, b.live = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// observe records activity seen by another proxy, if it is newer than any
+// seen here. It counts as stored, not being news to the store.
+func (s *routeState) observe(seen int64) {
+	for {
+		current := atomic.LoadInt64(&s.seen)
+		if seen <= current {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.seen, current, seen) {
+			atomic.StoreInt64(&s.stored, seen)
+			return
+		}
+	}
+}
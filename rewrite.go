@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Parts of the request path a route can strip before it is sent on
+const (
+	// stripFrontend removes the proxy's own path, --listenPath.
+	stripFrontend = "frontend"
+	// stripRoute removes the proxy's path and the route's FrontendPath, so
+	// the backend is served at its root.
+	stripRoute = "route"
+)
+
+var stripModes = map[string]bool{"": true, stripFrontend: true, stripRoute: true}
+
+// RewritePolicy describes how the path of a request is changed before it is
+// sent to the route's backend. The start of the path is stripped first, then
+// Prefix is put in its place and finally the Rules are applied in order. It
+// can also map the headers of responses on their way back.
+type RewritePolicy struct {
+	// Strip is frontend, route or empty to keep the whole path.
+	Strip string `xml:",omitempty" json:",omitempty"`
+	// Prefix is the path the backend expects to be served under.
+	Prefix string        `xml:",omitempty" json:",omitempty"`
+	Rules  []RewriteRule `xml:"Rules>Rule,omitempty" json:",omitempty"`
+	// ResponseHeaders maps the URLs in the Location, Content-Location and
+	// Refresh headers of responses, and the Path and Domain of their
+	// cookies, back under the route's path and host.
+	ResponseHeaders bool `xml:",omitempty" json:",omitempty"`
+}
+
+// RewriteRule replaces the matches of the regular expression Match in the
+// escaped path with Replace, which may refer to submatches as $1.
+type RewriteRule struct {
+	Match   string
+	Replace string
+}
+
+// rewriteRegexps caches the compiled Match of rewrite rules, as routes are
+// immutable and shared by concurrent requests. Routes of the same kind share
+// their rules, so it stays small.
+var rewriteRegexps sync.Map
+
+func rewriteRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := rewriteRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rewriteRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// validRewrite checks that a route's rewrite policy can be applied.
+func validRewrite(p *RewritePolicy) bool {
+	if p == nil {
+		return true
+	}
+	if !stripModes[p.Strip] {
+		log.Infof("A route with unknown rewrite strip %s was attempted", p.Strip)
+		return false
+	}
+	for _, rule := range p.Rules {
+		if _, err := rewriteRegexp(rule.Match); err != nil {
+			log.Infof("A route with invalid rewrite rule %q was attempted: %s", rule.Match, err)
+			return false
+		}
+	}
+	return true
+}
+
+// strippedPrefix returns the start of the request path which the route's
+// policy strips. Host routes are not served under the frontend's path.
+func (h *requestHandler) strippedPrefix(route *Route) string {
+	if route.Rewrite == nil {
+		return ""
+	}
+	var prefix string
+	if route.Host == "" {
+		prefix = h.Frontend.Path
+	}
+	switch route.Rewrite.Strip {
+	case stripFrontend:
+		return prefix
+	case stripRoute:
+		return strings.TrimSuffix(prefix+route.FrontendPath, "/")
+	}
+	return ""
+}
+
+// backendPath strips the start of an escaped request path and puts the
+// route's Prefix in its place, returning the new path and the part stripped.
+func (h *requestHandler) backendPath(route *Route, path string) (string, string) {
+	stripped := h.strippedPrefix(route)
+	if stripped != "" && strings.HasPrefix(path, stripped) {
+		path = path[len(stripped):]
+	} else {
+		stripped = ""
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(route.Rewrite.Prefix, "/") + path, stripped
+}
+
+// rewriteRequest applies the route's rewrite policy to the path of a request
+// about to be sent to its backend. If part of the path is stripped, it is
+// passed on in X-Forwarded-Prefix so that the backend can build URLs which
+// work for the user. A prefix sent by the client is never passed on.
+func (h *requestHandler) rewriteRequest(route *Route, r *http.Request) {
+	r.Header.Del("X-Forwarded-Prefix")
+	if route.Rewrite == nil {
+		return
+	}
+	path, stripped := h.backendPath(route, r.URL.EscapedPath())
+	if stripped != "" {
+		r.Header.Set("X-Forwarded-Prefix", stripped)
+	}
+	for _, rule := range route.Rewrite.Rules {
+		re, err := rewriteRegexp(rule.Match)
+		if err != nil {
+			routeFields(route).err(err).Warningf("Skipping rewrite rule %q", rule.Match)
+			continue
+		}
+		path = re.ReplaceAllString(path, rule.Replace)
+	}
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		routeFields(route).request(r).Warningf("Rewriting %s gave an invalid path %s", r.URL.Path, path)
+		return
+	}
+	r.URL.Path, r.URL.RawPath = unescaped, path
+}
+
+// responseRewriter maps the URLs in the headers of a backend's responses back
+// to those the user sees, so that redirects and cookies stay under the
+// route's path and host.
+type responseRewriter struct {
+	// backend is the address the request was sent to.
+	backend string
+	// host and scheme are those the user requested.
+	host   string
+	scheme string
+	// frontendBase is the path the route is served under, which the
+	// backend sees as backendBase. Neither has a trailing slash.
+	frontendBase string
+	backendBase  string
+}
+
+// newResponseRewriter returns the rewriter for responses to a request on the
+// route, or nil if the route keeps the headers of its responses as they are.
+// It must be called before the request is rewritten.
+func (h *requestHandler) newResponseRewriter(route *Route, r *http.Request) *responseRewriter {
+	if route.Rewrite == nil || !route.Rewrite.ResponseHeaders {
+		return nil
+	}
+	rw := &responseRewriter{backend: r.URL.Host, host: r.Host, scheme: "http"}
+	if r.TLS != nil {
+		rw.scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		rw.scheme = proto
+	}
+	if route.Host == "" {
+		rw.frontendBase = h.Frontend.Path
+	}
+	rw.frontendBase = strings.TrimSuffix(rw.frontendBase+route.FrontendPath, "/")
+	backendBase, _ := h.backendPath(route, rw.frontendBase)
+	rw.backendBase = strings.TrimSuffix(backendBase, "/")
+	return rw
+}
+
+// path maps an escaped path of the backend to the user's. Paths outside the
+// part of the backend the route serves are put under the route's path too,
+// unless the backend already put them there, as it does when it honours
+// X-Forwarded-Prefix.
+func (rw *responseRewriter) path(path string) string {
+	if rw.frontendBase != "" && (path == rw.frontendBase || strings.HasPrefix(path, rw.frontendBase+"/")) {
+		return path
+	}
+	if rw.backendBase == "" || path == rw.backendBase || strings.HasPrefix(path, rw.backendBase+"/") {
+		path = path[len(rw.backendBase):]
+	}
+	if path == "" {
+		path = "/"
+	}
+	return rw.frontendBase + path
+}
+
+// url maps a URL given by the backend to the user's. Relative URLs and those
+// pointing at other hosts are left alone.
+func (rw *responseRewriter) url(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	switch {
+	case u.Host == rw.backend:
+		u.Scheme, u.Host = rw.scheme, rw.host
+	case u.Host != "" && !strings.EqualFold(u.Host, rw.host):
+		return value
+	case u.Host == "" && !strings.HasPrefix(u.Path, "/"):
+		return value
+	}
+	path := rw.path(u.EscapedPath())
+	if u.Path, err = url.PathUnescape(path); err != nil {
+		return value
+	}
+	u.RawPath = path
+	return u.String()
+}
+
+// refresh maps the URL in a Refresh header, such as "5; url=/login".
+func (rw *responseRewriter) refresh(value string) string {
+	idx := strings.Index(strings.ToLower(value), "url=")
+	if idx < 0 {
+		return value
+	}
+	target := strings.TrimSpace(value[idx+len("url="):])
+	target = strings.Trim(target, `'"`)
+	return value[:idx+len("url=")] + rw.url(target)
+}
+
+// cookie maps the Path of a Set-Cookie header, and drops its Domain so that
+// the cookie only goes back to the host of the route, rather than the
+// backend's or those of other users' routes.
+func (rw *responseRewriter) cookie(value string) string {
+	parts := strings.Split(value, ";")
+	kept := []string{parts[0]}
+	for _, attr := range parts[1:] {
+		attr = strings.TrimSpace(attr)
+		name := strings.ToLower(attr)
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		switch name {
+		case "domain":
+			continue
+		case "path":
+			if i := strings.IndexByte(attr, '='); i >= 0 && strings.HasPrefix(strings.TrimSpace(attr[i+1:]), "/") {
+				attr = "Path=" + rw.path(strings.TrimSpace(attr[i+1:]))
+			}
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, "; ")
+}
+
+// rewrite maps the headers of a response.
+func (rw *responseRewriter) rewrite(header http.Header) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, rw.url(value))
+		}
+	}
+	if value := header.Get("Refresh"); value != "" {
+		header.Set("Refresh", rw.refresh(value))
+	}
+	for i, value := range header["Set-Cookie"] {
+		header["Set-Cookie"][i] = rw.cookie(value)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	h := &requestHandler{Frontend: &frontend{Path: "/gxproxy"}}
+	tests := []struct {
+		Host    string
+		Rewrite *RewritePolicy
+		Path    string
+		Sent    string
+		Prefix  string
+	}{
+		{"", nil, "/gxproxy/app/tree", "/gxproxy/app/tree", ""},
+		{"", &RewritePolicy{Strip: stripFrontend}, "/gxproxy/app/tree", "/app/tree", "/gxproxy"},
+		{"", &RewritePolicy{Strip: stripRoute}, "/gxproxy/app/tree", "/tree", "/gxproxy/app"},
+		{"", &RewritePolicy{Strip: stripRoute}, "/gxproxy/app", "/", "/gxproxy/app"},
+		{"", &RewritePolicy{Strip: stripRoute, Prefix: "/rstudio/"}, "/gxproxy/app/tree", "/rstudio/tree", "/gxproxy/app"},
+		{"", &RewritePolicy{Prefix: "/base"}, "/gxproxy/app/", "/base/gxproxy/app/", ""},
+		{"", &RewritePolicy{Strip: stripRoute, Rules: []RewriteRule{{`^/notebooks/(\w+)$`, "/nb/$1.ipynb"}}}, "/gxproxy/app/notebooks/x", "/nb/x.ipynb", "/gxproxy/app"},
+		{"", &RewritePolicy{Strip: stripRoute}, "/gxproxy/app/a%2Fb", "/a%2Fb", "/gxproxy/app"},
+		{"abc.example.org", &RewritePolicy{Strip: stripFrontend}, "/app/tree", "/app/tree", ""},
+		{"abc.example.org", &RewritePolicy{Strip: stripRoute}, "/app/tree", "/tree", "/app"},
+	}
+	for _, tc := range tests {
+		route := &Route{Host: tc.Host, FrontendPath: "/app", Rewrite: tc.Rewrite}
+		r := httptest.NewRequest("GET", "http://proxy"+tc.Path, nil)
+		r.Header.Set("X-Forwarded-Prefix", "/evil")
+		h.rewriteRequest(route, r)
+		if sent := r.URL.EscapedPath(); sent != tc.Sent {
+			t.Errorf("%s with %+v was sent as %s, expected %s", tc.Path, tc.Rewrite, sent, tc.Sent)
+		}
+		if prefix := r.Header.Get("X-Forwarded-Prefix"); prefix != tc.Prefix {
+			t.Errorf("%s with %+v was forwarded with prefix %q", tc.Path, tc.Rewrite, prefix)
+		}
+	}
+
+	if validRewrite(&RewritePolicy{Strip: "everything"}) || validRewrite(&RewritePolicy{Rules: []RewriteRule{{"(", ""}}}) {
+		t.Error("Invalid rewrite policies were accepted")
+	}
+}
+
+func TestRewriteProxy(t *testing.T) {
+	proxy, rm, route := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Prefix") + " " + r.URL.RequestURI()))
+	}))
+	snapshot := route.snapshot()
+	snapshot.Rewrite = &RewritePolicy{Strip: stripRoute}
+	if _, err := rm.UpdateRoute("test", route.ID, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(proxyRequest(proxy, "/gxproxy/app/tree?dir=x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "/gxproxy/app /tree?dir=x" {
+		t.Error("Backend was sent", string(body))
+	}
+}
+
+func TestResponseRewriter(t *testing.T) {
+	h := &requestHandler{Frontend: &frontend{Path: "/gxproxy"}}
+	request := func(route *Route) *responseRewriter {
+		r := httptest.NewRequest("GET", "http://proxy.example.org/gxproxy/app/x", nil)
+		r.URL.Host = "127.0.0.1:8888"
+		return h.newResponseRewriter(route, r)
+	}
+	if request(&Route{FrontendPath: "/app", Rewrite: &RewritePolicy{Strip: stripRoute}}) != nil {
+		t.Error("Response headers were rewritten without being asked to")
+	}
+
+	plain := request(&Route{FrontendPath: "/app", Rewrite: &RewritePolicy{ResponseHeaders: true}})
+	stripped := request(&Route{FrontendPath: "/app", Rewrite: &RewritePolicy{Strip: stripRoute, ResponseHeaders: true}})
+	prefixed := request(&Route{FrontendPath: "/app", Rewrite: &RewritePolicy{Strip: stripRoute, Prefix: "/rstudio", ResponseHeaders: true}})
+	host := request(&Route{Host: "abc.example.org", FrontendPath: "/", Rewrite: &RewritePolicy{ResponseHeaders: true}})
+
+	tests := []struct {
+		rw            *responseRewriter
+		Header, Value string
+		Expected      string
+	}{
+		{plain, "Location", "/login?next=%2F", "/gxproxy/app/login?next=%2F"},
+		{plain, "Location", "/gxproxy/app/tree", "/gxproxy/app/tree"},
+		{plain, "Location", "tree/", "tree/"},
+		{plain, "Location", "https://accounts.example.com/auth", "https://accounts.example.com/auth"},
+		{plain, "Location", "http://127.0.0.1:8888/login", "http://proxy.example.org/gxproxy/app/login"},
+		{stripped, "Location", "/login", "/gxproxy/app/login"},
+		{stripped, "Location", "http://proxy.example.org/", "http://proxy.example.org/gxproxy/app/"},
+		{stripped, "Content-Location", "/files/a%20b", "/gxproxy/app/files/a%20b"},
+		{stripped, "Location", "/gxproxy/app/tree", "/gxproxy/app/tree"},
+		{stripped, "Location", "http://proxy.example.org/gxproxy/app", "http://proxy.example.org/gxproxy/app"},
+		{stripped, "Location", "/gxproxy/application", "/gxproxy/app/gxproxy/application"},
+		{prefixed, "Location", "/gxproxy/app/auth-sign-in", "/gxproxy/app/auth-sign-in"},
+		{prefixed, "Location", "/rstudio/auth-sign-in", "/gxproxy/app/auth-sign-in"},
+		{prefixed, "Location", "/rstudio", "/gxproxy/app/"},
+		{prefixed, "Refresh", "0; url=/rstudio/", "0; url=/gxproxy/app/"},
+		{prefixed, "Refresh", "5", "5"},
+		{host, "Location", "/login", "/login"},
+		{stripped, "Set-Cookie", "session=x; Path=/; Domain=127.0.0.1; HttpOnly", "session=x; Path=/gxproxy/app/; HttpOnly"},
+		{prefixed, "Set-Cookie", "csrf=y; path=/rstudio/api; Secure", "csrf=y; Path=/gxproxy/app/api; Secure"},
+		{stripped, "Set-Cookie", "session=x; Path=/gxproxy/app", "session=x; Path=/gxproxy/app"},
+		{host, "Set-Cookie", "csrf=y; Path=/; Domain=.example.org", "csrf=y; Path=/"},
+	}
+	for _, tc := range tests {
+		header := http.Header{}
+		header.Set(tc.Header, tc.Value)
+		tc.rw.rewrite(header)
+		if got := header.Get(tc.Header); got != tc.Expected {
+			t.Errorf("%s: %s was rewritten to %s, expected %s", tc.Header, tc.Value, got, tc.Expected)
+		}
+	}
+}
+
+func TestResponseRewriteProxy(t *testing.T) {
+	proxy, rm, route := proxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "x", Path: "/"})
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	snapshot := route.snapshot()
+	snapshot.Rewrite = &RewritePolicy{Strip: stripRoute, ResponseHeaders: true}
+	if _, err := rm.UpdateRoute("test", route.ID, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultTransport.RoundTrip(proxyRequest(proxy, "/gxproxy/app/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if location := res.Header.Get("Location"); location != "/gxproxy/app/login" {
+		t.Error("Redirected to", location)
+	}
+	if cookie := res.Header.Get("Set-Cookie"); cookie != "session=x; Path=/gxproxy/app/" {
+		t.Error("Cookie set as", cookie)
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
+)
+
+// maxRemovals is how many removed routes are remembered.
+const maxRemovals = 100
 
-	docker "github.com/fsouza/go-dockerclient"
+var (
+	errRouteNotFound = errors.New("Could not find route")
+	errRouteConflict = errors.New("A route with that path already exists for that cookie")
 )
 
 // String representation of Route struct
 func (r Route) String() string {
-	return fmt.Sprintf("%s->%s (LastSeen @ %s, %d containers associated)", r.FrontendPath, r.BackendAddr, r.LastSeen, len(r.ContainerIds))
+	return fmt.Sprintf("%s%s->%s (LastSeen @ %s, %d containers associated)", r.Host, r.FrontendPath, strings.Join(r.backendAddrs(), ","), r.LastAccess(), len(r.ContainerIds))
 }
 
 // IsAuthorized checks if a user's cookie is valid for a given route object.
@@ -20,60 +29,260 @@ func (r *Route) IsAuthorized(cookie string) bool {
 	return r.AuthorizedCookie == cookie
 }
 
-// Seen notifies the route object that it was seen recently
+// Seen notifies the route object that it was seen recently. For routes that
+// belong to a RouteMapping this is safe to call from any goroutine; routes
+// which have not been added anywhere just record the time directly.
 func (r *Route) Seen() {
-	r.LastSeen = time.Now()
+	if r.live == nil {
+		r.LastSeen = time.Now()
+		return
+	}
+	atomic.StoreInt64(&r.live.seen, time.Now().UnixNano())
+}
+
+// LastAccess returns the last time the route was seen.
+func (r *Route) LastAccess() time.Time {
+	if r.live == nil {
+		return r.LastSeen
+	}
+	return time.Unix(0, atomic.LoadInt64(&r.live.seen))
+}
+
+// activate attaches fresh live state to a route about to be stored in a
+// RouteMapping, seeded from its LastSeen and State fields, which are assumed
+// to be stored already.
+func (r *Route) activate() {
+	seen := r.LastSeen.UnixNano()
+	r.live = &routeState{seen: seen, stored: seen}
+	if r.State != routePending {
+		r.live.ready = 1
+	}
+}
+
+// snapshot returns a detached copy of the route with LastSeen brought up to
+// date, suitable for serialization.
+func (r *Route) snapshot() Route {
+	c := *r
+	c.LastSeen = r.LastAccess()
+	c.State = r.state()
+	c.live = nil
+	return c
 }
 
 // String representation of RouteMapping struct
-func (rm RouteMapping) String() string {
-	return fmt.Sprintf("RouteMapping <%d routes under %s>", len(rm.Routes), rm.AuthCookieName)
+func (rm *RouteMapping) String() string {
+	return fmt.Sprintf("RouteMapping <%d routes under %s>", rm.Len(), rm.AuthCookieName)
 }
 
 // InitializeRouteMapper automatically loads the RouteMapping object from storage
-func InitializeRouteMapper(rm *RouteMapping) {
-	err := rm.restoreFromFile(rm.Storage)
+func InitializeRouteMapper(rm *RouteMapping) error {
+	if rm.Store == nil && rm.Storage != "" {
+		store, err := rm.openStore()
+		if err != nil {
+			return err
+		}
+		rm.Store = store
+	}
+	err := rm.restore()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Info("Restored %d RouteMapper routes from storage", len(rm.Routes))
+	log.Infof("Restored %d RouteMapper routes from storage", rm.Len())
+	atomic.StoreInt32(&rm.restored, 1)
+	rm.probePending()
 
-	client, err := docker.NewClient(rm.DockerEndpoint)
-	if err != nil {
-		// Panic if we can't kill containers
-		panic(err)
+	if err := rm.WatchStore(); err != nil {
+		return err
+	}
+
+	if err := rm.WatchContainers(); err != nil {
+		log.Warningf("Could not subscribe to container events, dead containers will only be noticed on access: %s", err)
 	}
-	rm.client = client
-	log.Info("Connected RouteMapper to Docker")
 
 	rm.RegisterCleaner()
+	return nil
+}
+
+// Len returns the number of routes currently registered.
+func (rm *RouteMapping) Len() int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return len(rm.routes)
+}
+
+// Snapshot returns a point-in-time copy of every route. The copies are
+// detached from the mapping and may be freely read or serialized.
+func (rm *RouteMapping) Snapshot() []Route {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	routes := make([]Route, 0, len(rm.routes))
+	for _, route := range rm.routes {
+		routes = append(routes, route.snapshot())
+	}
+	return routes
+}
+
+// setRoutes replaces the full set of routes, e.g. when restoring from
+// storage. Where several routes share a cookie and FrontendPath the last one
+// wins, as if they had been added in order.
+func (rm *RouteMapping) setRoutes(routes []Route) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.routes = make([]*Route, 0, len(routes))
+	rm.index = make(map[string]*radixTree)
+	rm.byID = make(map[string]*Route)
+	rm.hosts = make(map[string]int)
+	for idx := range routes {
+		route := routes[idx]
+		// Routes stored before IDs existed get one now
+		if route.ID == "" || rm.byID[route.ID] != nil {
+			route.ID = rm.newIDLocked()
+		}
+		route.activate()
+		rm.insertLocked(&route)
+	}
+}
+
+// newIDLocked generates a random route ID not currently in use. The caller
+// must hold rm.mu.
+func (rm *RouteMapping) newIDLocked() string {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		id := hex.EncodeToString(buf)
+		if _, ok := rm.byID[id]; !ok {
+			return id
+		}
+	}
+}
+
+// initLocked lazily sets up the indexes of a RouteMapping that was never
+// restored from storage. The caller must hold rm.mu for writing.
+func (rm *RouteMapping) initLocked() {
+	if rm.index == nil {
+		rm.index = make(map[string]*radixTree)
+		rm.byID = make(map[string]*Route)
+		rm.hosts = make(map[string]int)
+	}
+}
+
+// lookupLocked returns the route registered for exactly this cookie and
+// index key, if any. The caller must hold rm.mu.
+func (rm *RouteMapping) lookupLocked(cookie, key string) *Route {
+	if tree, ok := rm.index[cookie]; ok {
+		return tree.Get(key)
+	}
+	return nil
+}
+
+// insertLocked adds a route to both the route list and the index, returning
+// the route it displaced (same cookie, Host and FrontendPath), if any. The caller
+// must hold rm.mu for writing.
+func (rm *RouteMapping) insertLocked(route *Route) *Route {
+	tree, ok := rm.index[route.AuthorizedCookie]
+	if !ok {
+		tree = &radixTree{}
+		rm.index[route.AuthorizedCookie] = tree
+	}
+	old := tree.Insert(route.indexKey(), route)
+	if old != nil {
+		rm.unlistLocked(old)
+		delete(rm.byID, old.ID)
+	}
+	rm.routes = append(rm.routes, route)
+	rm.byID[route.ID] = route
+	rm.countHostLocked(route, 1)
+	return old
+}
+
+// replaceLocked swaps a stored route for an updated version of it, keeping
+// its position in the route list. The caller must hold rm.mu for writing and
+// have checked that next does not collide with another route.
+func (rm *RouteMapping) replaceLocked(current, next *Route) {
+	if tree, ok := rm.index[current.AuthorizedCookie]; ok && tree.Get(current.indexKey()) == current {
+		tree.Delete(current.indexKey())
+		if tree.Len() == 0 {
+			delete(rm.index, current.AuthorizedCookie)
+		}
+	}
+	tree, ok := rm.index[next.AuthorizedCookie]
+	if !ok {
+		tree = &radixTree{}
+		rm.index[next.AuthorizedCookie] = tree
+	}
+	tree.Insert(next.indexKey(), next)
+	for idx, x := range rm.routes {
+		if x == current {
+			routes := make([]*Route, len(rm.routes))
+			copy(routes, rm.routes)
+			routes[idx] = next
+			rm.routes = routes
+			rm.countHostLocked(current, -1)
+			rm.countHostLocked(next, 1)
+			break
+		}
+	}
+	rm.byID[next.ID] = next
+}
+
+// deleteLocked removes a route from both the route list and the index. The
+// caller must hold rm.mu for writing.
+func (rm *RouteMapping) deleteLocked(route *Route) {
+	if tree, ok := rm.index[route.AuthorizedCookie]; ok && tree.Get(route.indexKey()) == route {
+		tree.Delete(route.indexKey())
+		if tree.Len() == 0 {
+			delete(rm.index, route.AuthorizedCookie)
+		}
+	}
+	rm.unlistLocked(route)
+	if rm.byID[route.ID] == route {
+		delete(rm.byID, route.ID)
+	}
+}
+
+// unlistLocked removes a route from the ordered route list only.
+func (rm *RouteMapping) unlistLocked(route *Route) {
+	for idx, x := range rm.routes {
+		if x == route {
+			rm.routes = append(rm.routes[:idx:idx], rm.routes[idx+1:]...)
+			rm.countHostLocked(route, -1)
+			return
+		}
+	}
 }
 
 // RemoveDeadContainers finds containers with no traffic which should be
 // killed. The function kills that route's containers, removes the route, and
-// saves to file.
+// stores the activity of the remaining ones.
 func (rm *RouteMapping) RemoveDeadContainers() {
-	for _, route := range rm.Routes {
-		if time.Since(route.LastSeen) > rm.NoAccessThreshold {
-			log.Info("Found expired route %s", route)
-			rm.RemoveRoute(&route)
+	if !rm.holdsCleanerLease() {
+		// Another proxy sharing the store takes care of it, but it needs
+		// to know about our traffic
+		rm.Save()
+		return
+	}
+	defer func(start time.Time) {
+		metrics.cleanerRan(time.Since(start))
+	}(time.Now())
+	var expired []*Route
+	rm.mu.RLock()
+	for _, route := range rm.routes {
+		// Pending routes are subject to the startup timeout instead
+		if route.IsReady() && time.Since(route.LastAccess()) > rm.NoAccessThreshold {
+			expired = append(expired, route)
 		}
 	}
-	rm.Save()
-}
+	rm.mu.RUnlock()
 
-// KillContainers kills all containers associated with a route
-func (r *Route) KillContainers(rm *RouteMapping) {
-	for _, containerID := range r.ContainerIds {
-		log.Info("Killing %s", containerID)
-		err := rm.client.KillContainer(docker.KillContainerOptions{
-			ID:     containerID,
-			Signal: 9,
-		})
-		if err != nil {
-			log.Warning("Error killing container: %s", err)
+	for _, route := range expired {
+		routeFields(route).Infof("Found expired route, last seen @ %s", route.LastAccess())
+		if rm.removeRoute(actorCleaner, route, fmt.Sprintf("no access for %s", rm.NoAccessThreshold)) {
+			atomic.AddInt64(&metrics.expired, 1)
 		}
 	}
+	rm.Save()
 }
 
 // RegisterCleaner sets up a goroutine with a ticker every N seconds which
@@ -83,8 +292,8 @@ func (rm *RouteMapping) RegisterCleaner() {
 	ticker := time.NewTicker(rm.CleanInterval)
 	go func(routeMapping *RouteMapping) {
 		for range ticker.C {
-			log.Info("Running goroutines: %d", runtime.NumGoroutine())
-			rm.RemoveDeadContainers()
+			log.Infof("Running goroutines: %d", runtime.NumGoroutine())
+			routeMapping.RemoveDeadContainers()
 		}
 	}(rm)
 }
@@ -92,42 +301,177 @@ func (rm *RouteMapping) RegisterCleaner() {
 // FindRoute locates a given route based on the URL the request is
 // requesting, and the user's cookie. This allows us to have multiple
 // /ipython routes that map to different backends, based on who is
-// requesting.
+// requesting. Amongst the user's routes, the one with the longest
+// FrontendPath that prefixes url wins.
 func (rm *RouteMapping) FindRoute(url string, cookie string) (*Route, error) {
-	for idx := range rm.Routes {
-		if strings.HasPrefix(url, rm.Routes[idx].FrontendPath) && rm.Routes[idx].IsAuthorized(cookie) {
-			return &rm.Routes[idx], nil
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if tree, ok := rm.index[cookie]; ok {
+		if route := tree.LongestPrefix(url); route != nil {
+			return route, nil
+		}
+	}
+	return &Route{}, errRouteNotFound
+}
+
+// FindHostRoute locates the user's route for a request to host, which may
+// carry a port. Routes for the exact host are preferred over wildcard ones,
+// and the longest wildcard suffix wins; amongst the routes for that pattern
+// the longest FrontendPath that prefixes url does.
+func (rm *RouteMapping) FindHostRoute(host, url, cookie string) (*Route, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if tree, ok := rm.index[cookie]; ok {
+		for _, pattern := range hostPatterns(requestHost(host)) {
+			if route := tree.LongestPrefix(hostKey(pattern) + url); route != nil {
+				return route, nil
+			}
 		}
 	}
-	return &Route{}, errors.New("Could not find route")
+	return &Route{}, errRouteNotFound
+}
+
+// GetRoute returns the route with the given ID.
+func (rm *RouteMapping) GetRoute(id string) (*Route, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if route, ok := rm.byID[id]; ok {
+		return route, nil
+	}
+	return nil, errRouteNotFound
 }
 
-// AddRoute adds a new route
-func (rm *RouteMapping) AddRoute(url string, backend string, cookie string, containers []string) {
-	r := &Route{
-		FrontendPath:     url,
-		BackendAddr:      backend,
-		AuthorizedCookie: cookie,
-		LastSeen:         time.Now(),
-		ContainerIds:     containers,
+// AddRoute adds a new route, assigning it a fresh ID, and returns the stored
+// route. A route already registered for the same cookie and FrontendPath is
+// replaced, and those of its containers which the new route does not reuse
+// are torn down. The actor is recorded in the audit log.
+func (rm *RouteMapping) AddRoute(actor string, route Route) *Route {
+	r := &route
+	r.LastSeen = time.Now()
+	r.State = routeReady
+	if rm.ProbeInterval > 0 {
+		r.State = routePending
+	}
+	r.activate()
+
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+	rm.mu.Lock()
+	rm.initLocked()
+	r.ID = rm.newIDLocked()
+	old := rm.insertLocked(r)
+	var removal *RouteRemoval
+	if old != nil {
+		removal = rm.retireLocked(old, "replaced by route "+r.ID)
 	}
+	rm.mu.Unlock()
+	routeFields(r).Infof("Adding new route")
 
-	log.Info("Adding new route %s", r)
-	rm.Routes = append(rm.Routes, *r)
+	var deleted []string
+	if old != nil {
+		routeFields(old).Infof("Replaced route")
+		rm.Audit.record(auditDelete, actor, removal.Reason, old, nil)
+		deleted = append(deleted, old.ID)
+		var orphaned []string
+		for _, id := range old.ContainerIds {
+			if !r.hasContainer(id) {
+				orphaned = append(orphaned, id)
+			}
+		}
+		rm.startTeardown(old, orphaned, removal)
+	}
+	rm.Audit.record(auditCreate, actor, "", nil, r)
 	// After we add a route, we update the storage map
-	rm.Save()
+	rm.persist([]*Route{r}, deleted)
+	rm.startProbe(r)
+	return r
 }
 
-// RemoveRoute removes a route
-func (rm *RouteMapping) RemoveRoute(route *Route) {
-	// More generic cleanup method for route?
-	route.KillContainers(rm)
-	// Then remove the route proper
-	for idx, x := range rm.Routes {
-		// TODO
-		if route.FrontendPath == x.FrontendPath && route.BackendAddr == x.BackendAddr && route.AuthorizedCookie == x.AuthorizedCookie {
-			rm.Routes = rm.Routes[:idx+copy(rm.Routes[idx:], rm.Routes[idx+1:])]
-			return
+// UpdateRoute replaces the definition of the route with the given ID,
+// keeping its ID and activity. Containers which are no longer listed are left
+// running.
+func (rm *RouteMapping) UpdateRoute(actor, id string, route Route) (*Route, error) {
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+	rm.mu.Lock()
+	current, ok := rm.byID[id]
+	if !ok {
+		rm.mu.Unlock()
+		return nil, errRouteNotFound
+	}
+	if other := rm.lookupLocked(route.AuthorizedCookie, route.indexKey()); other != nil && other != current {
+		rm.mu.Unlock()
+		return nil, errRouteConflict
+	}
+	next := &route
+	next.ID = current.ID
+	next.LastSeen = current.LastSeen
+	next.live = current.live
+	rm.replaceLocked(current, next)
+	rm.mu.Unlock()
+
+	routeFields(next).Infof("Updated route")
+	rm.Audit.record(auditUpdate, actor, "", current, next)
+	rm.persist([]*Route{next}, nil)
+	return next, nil
+}
+
+// hasContainer reports whether the container is associated with the route.
+func (r *Route) hasContainer(id string) bool {
+	for _, containerID := range r.ContainerIds {
+		if containerID == id {
+			return true
 		}
 	}
+	return false
+}
+
+// RemoveRoute removes a route, tears down its containers in the background
+// and deletes it from storage. The reason is recorded in the removal history,
+// and along with the actor in the audit log.
+func (rm *RouteMapping) RemoveRoute(actor string, route *Route, reason string) {
+	rm.removeRoute(actor, route, reason)
+}
+
+// Removals returns the most recently removed routes, oldest first.
+func (rm *RouteMapping) Removals() []RouteRemoval {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	removals := make([]RouteRemoval, 0, len(rm.removals))
+	for _, removal := range rm.removals {
+		removals = append(removals, *removal)
+	}
+	return removals
+}
+
+// removeRoute drops a route from the mapping and, if it was still present,
+// tears down its containers. Only the caller that actually removed the route
+// performs the teardown, so concurrent removals don't kill twice. The route may
+// be a copy, in which case it is matched on ID, or on cookie, path and
+// backend if it has none.
+func (rm *RouteMapping) removeRoute(actor string, route *Route, reason string) bool {
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+	rm.mu.Lock()
+	var removed *Route
+	if route.ID != "" {
+		removed = rm.byID[route.ID]
+	} else if x := rm.lookupLocked(route.AuthorizedCookie, route.indexKey()); x != nil && x.BackendAddr == route.BackendAddr {
+		removed = x
+	}
+	var removal *RouteRemoval
+	if removed != nil {
+		rm.deleteLocked(removed)
+		removal = rm.retireLocked(removed, reason)
+	}
+	rm.mu.Unlock()
+
+	if removed == nil {
+		return false
+	}
+	routeFields(removed).Infof("Removed route: %s", reason)
+	rm.Audit.record(auditDelete, actor, reason, removed, nil)
+	rm.persist(nil, []string{removed.ID})
+	rm.startTeardown(removed, removed.ContainerIds, removal)
+	return true
 }
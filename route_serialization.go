@@ -3,67 +3,235 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
-// Save is a convenience function to automatically serialize to default
-// storage location.
-func (rm *RouteMapping) Save() {
-	// Already handled errors in StoreToFile()'s logging
-	_ = rm.StoreToFile(rm.Storage)
+// xmlStore keeps every route in a single XML file, which is rewritten on
+// each change. The file is replaced atomically, so a crash mid-write leaves
+// the previous version in place, and the previous backups versions are kept
+// as path.1, path.2 and so on.
+type xmlStore struct {
+	path    string
+	backups int
+	// meta is written alongside the routes, for reference only.
+	meta routeMappingFile
+
+	mu     sync.Mutex
+	routes []Route
+}
+
+func newXMLStore(path string, backups int, meta routeMappingFile) *xmlStore {
+	return &xmlStore{path: path, backups: backups, meta: meta}
+}
+
+// Load reads the newest snapshot that can be parsed. If none exist the store
+// starts empty, but if all are unreadable that is an error.
+func (s *xmlStore) Load() ([]Route, error) {
+	candidates := []string{s.path}
+	for i := 1; i <= s.backups; i++ {
+		candidates = append(candidates, backupName(s.path, i))
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		data, err := ioutil.ReadFile(candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error reading %s", err)
+			lastErr = err
+			continue
+		}
+
+		// Unmarshal into a separate object, because we only want the routes
+		rm2 := &routeMappingFile{}
+		if err := xml.Unmarshal(data, rm2); err != nil {
+			log.Errorf("Error unmarshalling %s: %s", candidate, err)
+			lastErr = fmt.Errorf("%s: %s", candidate, err)
+			continue
+		}
+		if candidate != s.path {
+			log.Warningf("Storage %s is unusable, restored from snapshot %s", s.path, candidate)
+		}
+		s.mu.Lock()
+		s.routes = append([]Route(nil), rm2.Routes...)
+		s.mu.Unlock()
+		return rm2.Routes, nil
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("no usable snapshot of %s, last error: %s", s.path, lastErr)
+	}
+	// If no file exists, start empty.
+	log.Info("No file exists")
+	return nil, nil
+}
+
+// Put replaces or appends the routes and rewrites the file.
+func (s *xmlStore) Put(routes ...Route) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, route := range routes {
+		found := false
+		for idx := range s.routes {
+			if s.routes[idx].ID == route.ID {
+				s.routes[idx] = route
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.routes = append(s.routes, route)
+		}
+	}
+	return s.write()
 }
 
-// StoreToFile serializes the routemappings object to an XML file.
-func (rm *RouteMapping) StoreToFile(path string) error {
-	f, err := os.Create(path)
+// Delete drops the routes and rewrites the file.
+func (s *xmlStore) Delete(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := make(map[string]bool)
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	routes := s.routes[:0]
+	for _, route := range s.routes {
+		if !deleted[route.ID] {
+			routes = append(routes, route)
+		}
+	}
+	s.routes = routes
+	return s.write()
+}
+
+// Close does nothing, every change is already on disk.
+func (s *xmlStore) Close() error {
+	return nil
+}
+
+// write serializes the routes to the file. The caller must hold s.mu.
+func (s *xmlStore) write() error {
+	file := s.meta
+	file.Routes = s.routes
+	output, err := xml.MarshalIndent(&file, "", "    ")
 	if err != nil {
-		log.Error(fmt.Sprintf("Could not create file %s", err))
+		log.Errorf("Error marshalling %s", err)
 		return err
 	}
 
-	output, err := xml.MarshalIndent(rm, "", "    ")
+	err = writeFileAtomic(s.path, output, s.backups)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error marshalling %s", err))
+		log.Errorf("Error writing %s", err)
 		return err
 	}
+	return nil
+}
+
+// backupName returns the name of the n-th previous snapshot of path.
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
 
-	_, err = f.Write(output)
+// writeFileAtomic replaces path with data such that readers, and the next
+// start after a crash, see either the old or the new contents in full. The
+// previous contents are kept as the most recent of backups rotated
+// snapshots.
+func writeFileAtomic(path string, data []byte, backups int) error {
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to replace %s, it is not a regular file", path)
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
 	if err != nil {
-		log.Error(fmt.Sprintf("Error writing %s", err))
 		return err
 	}
+	// Only has an effect if we fail before the rename
+	defer os.Remove(tmp.Name())
 
-	err = f.Close()
-	if err != nil {
-		log.Error(fmt.Sprintf("Error closing %s", err))
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
 		return err
 	}
-	return nil
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if err := rotateBackups(path, backups); err != nil {
+			log.Warningf("Could not rotate snapshots of %s: %s", path, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
 
-func (rm *RouteMapping) restoreFromFile(path string) error {
-	// If the file doesn't exist, just return.
+// rotateBackups shifts path.1 to path.2 and so on, dropping the oldest, and
+// makes the current contents of path the new path.1. path itself is left in
+// place, so there is no moment without a current file.
+func rotateBackups(path string, backups int) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		log.Info("No file exists")
-		rm.Routes = make([]Route, 0)
 		return nil
 	}
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backupName(path, i), backupName(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	newest := backupName(path, 1)
+	if err := os.Remove(newest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(path, newest); err == nil {
+		return nil
+	}
+	// Some filesystems don't support hard links
+	return copyFile(path, newest)
+}
 
-	data, err := ioutil.ReadFile(path)
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error reading %s", err))
 		return err
 	}
-
-	// Unmarshal into a separate object, because we only want the routes
-	rm2 := &RouteMapping{}
-	if err := xml.Unmarshal(data, &rm2); err != nil {
-		log.Error(fmt.Sprintf("Error unmarshalling %s", err))
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
 		return err
 	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	rm.Routes = rm2.Routes
-
-	return nil
+// syncDir flushes a directory, making renames within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestXMLStoreSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessionMap.xml")
+
+	rm := &RouteMapping{Store: newXMLStore(path, 2, routeMappingFile{})}
+	for _, frontendPath := range []string{"/a", "/b", "/c", "/d"} {
+		rm.AddRoute("test", Route{FrontendPath: frontendPath, BackendAddr: "x", AuthorizedCookie: "c"})
+	}
+
+	// Each save rotated the previous version away, keeping only two
+	expected := map[string]int{path: 4, path + ".1": 3, path + ".2": 2}
+	for file, routes := range expected {
+		restored := &RouteMapping{Store: newXMLStore(file, 0, routeMappingFile{})}
+		if err := restored.restore(); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Len() != routes {
+			t.Error("Expected", routes, "routes in", file, "found", restored.Len())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Kept more snapshots than configured")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, ".*tmp*"))
+	if len(files) > 0 {
+		t.Error("Temporary files left behind", files)
+	}
+
+	// A truncated file falls back to the newest valid snapshot
+	if err := ioutil.WriteFile(path, []byte("<RouteMapping><Rou"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restored := &RouteMapping{Store: newXMLStore(path, 2, routeMappingFile{})}
+	if err := restored.restore(); err != nil {
+		t.Fatal("Did not fall back to a snapshot", err)
+	}
+	if restored.Len() != 3 {
+		t.Error("Expected the 3 routes of the newest snapshot, found", restored.Len())
+	}
+
+	// Nothing usable at all is an error rather than silently starting empty
+	for _, file := range []string{path + ".1", path + ".2"} {
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restored.restore(); err == nil {
+		t.Error("Expected an error without any valid snapshot")
+	}
+
+	// No storage at all is a fresh start
+	fresh := &RouteMapping{Store: newXMLStore(filepath.Join(dir, "missing.xml"), 2, routeMappingFile{})}
+	if err := fresh.restore(); err != nil || fresh.Len() != 0 {
+		t.Error("Expected an empty mapping from missing storage", fresh.Len(), err)
+	}
+}
+
+func TestXMLStoreRefusesDevices(t *testing.T) {
+	store := newXMLStore(os.DevNull, 0, routeMappingFile{})
+	if err := store.Put(Route{ID: "x"}); err == nil {
+		t.Error("Expected refusal to replace", os.DevNull)
+	}
+	if info, err := os.Stat(os.DevNull); err != nil || info.Mode().IsRegular() {
+		t.Fatal(os.DevNull, "was replaced")
+	}
+}
@@ -2,6 +2,14 @@ package main
 
 import (
 	//"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,12 +94,42 @@ func TestFindRoute(t *testing.T) {
 			Msg:       "Do not excpect to return from empty route list",
 			RouteList: []Route{},
 		},
+		{
+			URL:    "/ipython/12/api/kernels",
+			Cookie: "valid",
+			Result: &Route{FrontendPath: "/ipython/12", BackendAddr: "b"},
+			Msg:    "Longest matching prefix wins regardless of order",
+			RouteList: []Route{
+				{FrontendPath: "/ipython", BackendAddr: "a", AuthorizedCookie: "valid"},
+				{FrontendPath: "/ipython/12", BackendAddr: "b", AuthorizedCookie: "valid"},
+				{FrontendPath: "/ipython/1", BackendAddr: "c", AuthorizedCookie: "valid"},
+			},
+		},
+		{
+			URL:    "/ipython/12/api/kernels",
+			Cookie: "other",
+			Result: &Route{FrontendPath: "/ipython", BackendAddr: "d"},
+			Msg:    "Only the user's own routes are considered",
+			RouteList: []Route{
+				{FrontendPath: "/ipython/12", BackendAddr: "b", AuthorizedCookie: "valid"},
+				{FrontendPath: "/ipython", BackendAddr: "d", AuthorizedCookie: "other"},
+			},
+		},
+		{
+			URL:    "/ipython/12",
+			Cookie: "valid",
+			Result: &Route{FrontendPath: "/ipython/12", BackendAddr: "e"},
+			Msg:    "Later routes replace earlier ones with the same path",
+			RouteList: []Route{
+				{FrontendPath: "/ipython/12", BackendAddr: "b", AuthorizedCookie: "valid"},
+				{FrontendPath: "/ipython/12", BackendAddr: "e", AuthorizedCookie: "valid"},
+			},
+		},
 	}
 
 	for _, tc := range tests {
-		rm := &RouteMapping{
-			Routes: tc.RouteList,
-		}
+		rm := &RouteMapping{}
+		rm.setRoutes(tc.RouteList)
 
 		result, err := rm.FindRoute(tc.URL, tc.Cookie)
 
@@ -101,7 +139,7 @@ func TestFindRoute(t *testing.T) {
 			}
 		}
 
-		if result.FrontendPath != tc.Result.FrontendPath || result.BackendAddr != result.BackendAddr {
+		if result.FrontendPath != tc.Result.FrontendPath || result.BackendAddr != tc.Result.BackendAddr {
 			t.Error(
 				"For", tc.URL, "and",
 				tc.Cookie, "expected", tc.Result,
@@ -110,3 +148,119 @@ func TestFindRoute(t *testing.T) {
 		}
 	}
 }
+
+func TestRouteMappingConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+
+	rm := &RouteMapping{
+		AuthCookieName:    "sid",
+		Store:             newXMLStore(filepath.Join(dir, "sessionMap.xml"), 0, routeMappingFile{}),
+		NoAccessThreshold: time.Hour,
+	}
+	rm.setRoutes(nil)
+	f := &frontend{Path: "/gxproxy", APIKeys: testKeyring()}
+	proxy := httptest.NewServer(&requestHandler{
+		Transport:    &http.Transport{},
+		RouteMapping: rm,
+		Frontend:     f,
+	})
+	defer proxy.Close()
+	api := httptest.NewServer(&apiHandler{RouteMapping: rm, Frontend: f})
+	defer api.Close()
+
+	const workers = 8
+	const iterations = 20
+	for i := 0; i < workers; i++ {
+		rm.AddRoute("test", Route{FrontendPath: fmt.Sprintf("/ipython/%d", i), BackendAddr: backendAddr, AuthorizedCookie: fmt.Sprintf("cookie%d", i)})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(4)
+		// Proxy traffic against the long-lived routes
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				req, _ := http.NewRequest("GET", fmt.Sprintf("%s/gxproxy/ipython/%d/", proxy.URL, i), nil)
+				req.AddCookie(&http.Cookie{Name: "sid", Value: fmt.Sprintf("cookie%d", i)})
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != 200 || string(body) != "ok" {
+					t.Error("Proxying route", i, "returned", res.StatusCode, string(body))
+				}
+			}
+		}(i)
+		// API listing and creation
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				route := fmt.Sprintf(`{"FrontendPath": "/api/%d/%d", "BackendAddr": "%s", "AuthorizedCookie": "api%d"}`, i, j, backendAddr, i)
+				if _, code, err := post(api, "/api?api_key=supersecret", []byte(route)); err != nil || code != 200 {
+					t.Error("Adding route failed", code, err)
+				}
+				if _, code, err := get(api, "/api?api_key=supersecret"); err != nil || code != 200 {
+					t.Error("Listing routes failed", code, err)
+				}
+			}
+		}(i)
+		// The cleaner, racing with short lived routes expiring underneath it
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				route := rm.AddRoute("test", Route{FrontendPath: fmt.Sprintf("/expired/%d/%d", i, j), BackendAddr: backendAddr, AuthorizedCookie: "expired"})
+				atomic.StoreInt64(&route.live.seen, 0)
+				rm.RemoveDeadContainers()
+			}
+		}(i)
+		// Direct lookups, activity and removals
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if route, err := rm.FindRoute(fmt.Sprintf("/ipython/%d", i), fmt.Sprintf("cookie%d", i)); err == nil {
+					route.Seen()
+					_ = route.String()
+				}
+				for _, route := range rm.Snapshot() {
+					if route.AuthorizedCookie == fmt.Sprintf("api%d", i) {
+						rm.RemoveRoute("test", &route, "test")
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, route := range rm.Snapshot() {
+		if route.AuthorizedCookie == "expired" {
+			t.Error("Expired route survived the cleaner", route)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		if _, err := rm.FindRoute(fmt.Sprintf("/ipython/%d", i), fmt.Sprintf("cookie%d", i)); err != nil {
+			t.Error("Lost long-lived route", i)
+		}
+	}
+
+	restored := &RouteMapping{Store: newXMLStore(filepath.Join(dir, "sessionMap.xml"), 0, routeMappingFile{})}
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != rm.Len() {
+		t.Error("Restored", restored.Len(), "routes, expected", rm.Len())
+	}
+}
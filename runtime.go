@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ContainerRuntime manages the containers (or pods, or processes) backing a
+// route.
+type ContainerRuntime interface {
+	// Kill immediately terminates a container.
+	Kill(id string) error
+	// Stop asks a container to shut down, killing it if it has not exited
+	// within the timeout.
+	Stop(id string, timeout time.Duration) error
+	// Remove deletes a stopped container, and its anonymous volumes if
+	// asked to.
+	Remove(id string, volumes bool) error
+	// Inspect reports the current state of a container.
+	Inspect(id string) (*ContainerStatus, error)
+	// Alive reports whether a container is still running. A container that
+	// no longer exists is not alive, and is not an error.
+	Alive(id string) (bool, error)
+}
+
+// containerWatcher is implemented by runtimes which can push notifications
+// about containers dying, rather than having to be polled.
+type containerWatcher interface {
+	// WatchDeaths calls fn with the ID of every container which dies or is
+	// removed, along with the runtime specific event name.
+	WatchDeaths(fn func(id string, event string)) error
+}
+
+// ContainerStatus describes a container as reported by its runtime.
+type ContainerStatus struct {
+	ID      string
+	Running bool
+	// State is the runtime's own description, e.g. "exited" or "Pending".
+	State string
+}
+
+// Names of the built in runtimes
+const (
+	runtimeDocker     = "docker"
+	runtimePodman     = "podman"
+	runtimeKubernetes = "kubernetes"
+	runtimeProcess    = "process"
+	runtimeNone       = "none"
+)
+
+// runtimeConfig holds the settings for the built in runtimes.
+type runtimeConfig struct {
+	// Default is the runtime used by routes which don't name one.
+	Default        string
+	DockerEndpoint string
+	DockerTLS      dockerTLS
+	PodmanEndpoint string
+	KubeAPI        string
+	KubeNamespace  string
+	KubeTokenFile  string
+	KubeCAFile     string
+	// AllowProcess lets routes manage local processes even when process is
+	// not the default runtime. Any API key which can write routes can then
+	// have the proxy kill any PID it may signal.
+	AllowProcess bool
+}
+
+// newContainerRuntimes builds every runtime that can be set up from the
+// configuration. Only failing to set up the default runtime is an error.
+func newContainerRuntimes(cfg runtimeConfig) (map[string]ContainerRuntime, error) {
+	runtimes := map[string]ContainerRuntime{
+		runtimeNone: noopRuntime{},
+	}
+	if cfg.Default == runtimeProcess || cfg.AllowProcess {
+		runtimes[runtimeProcess] = &processRuntime{pollInterval: 100 * time.Millisecond}
+	}
+	add := func(name string, rt ContainerRuntime, err error) error {
+		if err == nil {
+			runtimes[name] = rt
+			return nil
+		}
+		if name == cfg.Default {
+			return fmt.Errorf("%s runtime: %s", name, err)
+		}
+		log.Infof("The %s runtime is not available: %s", name, err)
+		return nil
+	}
+
+	// Only the default runtime is checked, the daemons of the others may
+	// well come up later
+	docker, err := newDockerRuntime(cfg.DockerEndpoint, cfg.DockerTLS)
+	if err == nil && cfg.Default == runtimeDocker {
+		err = docker.Ping()
+	}
+	if err := add(runtimeDocker, docker, err); err != nil {
+		return nil, err
+	}
+	podman, err := newDockerRuntime(cfg.PodmanEndpoint, dockerTLS{})
+	if err == nil && cfg.Default == runtimePodman {
+		err = podman.Ping()
+	}
+	if err := add(runtimePodman, podman, err); err != nil {
+		return nil, err
+	}
+	kubernetes, err := newKubernetesRuntime(cfg.KubeAPI, cfg.KubeNamespace, cfg.KubeTokenFile, cfg.KubeCAFile)
+	if err := add(runtimeKubernetes, kubernetes, err); err != nil {
+		return nil, err
+	}
+
+	if _, ok := runtimes[cfg.Default]; !ok {
+		return nil, fmt.Errorf("unknown container runtime %q", cfg.Default)
+	}
+	return runtimes, nil
+}
+
+// runtimeName returns the name of the runtime managing a route's containers.
+func (rm *RouteMapping) runtimeName(r *Route) string {
+	if r.Runtime == "" {
+		return rm.DefaultRuntime
+	}
+	return r.Runtime
+}
+
+// runtimeFor returns the runtime which manages a route's containers.
+func (rm *RouteMapping) runtimeFor(r *Route) ContainerRuntime {
+	name := rm.runtimeName(r)
+	if rt, ok := rm.Runtimes[name]; ok {
+		return rt
+	}
+	if len(r.ContainerIds) > 0 {
+		log.Warningf("No container runtime %q is configured, leaving containers of %s alone", name, r)
+	}
+	return noopRuntime{}
+}
+
+// HasRuntime checks whether a route may name this runtime. The empty name
+// selects the default runtime.
+func (rm *RouteMapping) HasRuntime(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := rm.Runtimes[name]
+	return ok
+}
+
+// noopRuntime is used for routes whose backends are not managed by the
+// proxy. It never touches anything and considers everything alive.
+type noopRuntime struct{}
+
+func (noopRuntime) Kill(id string) error                        { return nil }
+func (noopRuntime) Stop(id string, timeout time.Duration) error { return nil }
+func (noopRuntime) Remove(id string, volumes bool) error        { return nil }
+func (noopRuntime) Alive(id string) (bool, error)               { return true, nil }
+
+func (noopRuntime) Inspect(id string) (*ContainerStatus, error) {
+	return &ContainerStatus{ID: id, Running: true, State: "unmanaged"}, nil
+}
+
+// processRuntime manages plain local processes, identified by their PID.
+type processRuntime struct {
+	// pollInterval is how often Stop checks whether the process exited.
+	pollInterval time.Duration
+}
+
+func (p *processRuntime) pid(id string) (int, error) {
+	pid, err := strconv.Atoi(id)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid process id %q", id)
+	}
+	return pid, nil
+}
+
+func (p *processRuntime) signal(id string, sig syscall.Signal) error {
+	pid, err := p.pid(id)
+	if err != nil {
+		return err
+	}
+	err = syscall.Kill(pid, sig)
+	if err == syscall.ESRCH {
+		// Already gone
+		return nil
+	}
+	return err
+}
+
+func (p *processRuntime) Kill(id string) error {
+	return p.signal(id, syscall.SIGKILL)
+}
+
+func (p *processRuntime) Stop(id string, timeout time.Duration) error {
+	if err := p.signal(id, syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if alive, err := p.Alive(id); err != nil || !alive {
+			return err
+		}
+		time.Sleep(p.pollInterval)
+	}
+	return p.Kill(id)
+}
+
+// Remove is a no-op, an exited process leaves nothing behind.
+func (p *processRuntime) Remove(id string, volumes bool) error {
+	return nil
+}
+
+func (p *processRuntime) Alive(id string) (bool, error) {
+	pid, err := p.pid(id)
+	if err != nil {
+		return false, err
+	}
+	// Signal 0 only checks for existence. EPERM means it exists but belongs
+	// to someone else.
+	err = syscall.Kill(pid, 0)
+	if err == nil || err == syscall.EPERM {
+		return !p.zombie(pid), nil
+	}
+	if err == syscall.ESRCH {
+		return false, nil
+	}
+	return false, err
+}
+
+// zombie checks whether a process has exited but not been reaped yet.
+func (p *processRuntime) zombie(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name, which may itself
+	// contain spaces or parentheses.
+	for i := len(stat) - 1; i >= 0; i-- {
+		if stat[i] == ')' {
+			return i+2 < len(stat) && stat[i+2] == 'Z'
+		}
+	}
+	return false
+}
+
+func (p *processRuntime) Inspect(id string) (*ContainerStatus, error) {
+	alive, err := p.Alive(id)
+	if err != nil {
+		return nil, err
+	}
+	status := &ContainerStatus{ID: id, Running: alive, State: "exited"}
+	if alive {
+		status.State = "running"
+	}
+	return status, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// dockerPingTimeout is how long the daemon has to answer on startup.
+const dockerPingTimeout = 10 * time.Second
+
+// dockerRuntime manages Docker containers. Podman's Docker compatible API
+// socket is driven through it as well.
+type dockerRuntime struct {
+	endpoint string
+	client   *docker.Client
+}
+
+// dockerTLS holds the PEM files for talking to a daemon which requires TLS.
+// Without a CA the daemon's certificate is not verified.
+type dockerTLS struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// enabled reports whether TLS should be used at all.
+func (t dockerTLS) enabled() bool {
+	return t.Cert != "" || t.Key != "" || t.CA != ""
+}
+
+// withEnv fills in settings the flags did not give the way the docker
+// command does: with DOCKER_TLS_VERIFY or DOCKER_CERT_PATH set, cert.pem and
+// key.pem are taken from DOCKER_CERT_PATH (~/.docker by default), and
+// ca.pem as well if DOCKER_TLS_VERIFY is set.
+func (t dockerTLS) withEnv(getenv func(string) string) dockerTLS {
+	verify := getenv("DOCKER_TLS_VERIFY") != ""
+	path := getenv("DOCKER_CERT_PATH")
+	if t.enabled() || (!verify && path == "") {
+		return t
+	}
+	if path == "" {
+		path = filepath.Join(getenv("HOME"), ".docker")
+	}
+	t.Cert = filepath.Join(path, "cert.pem")
+	t.Key = filepath.Join(path, "key.pem")
+	if verify {
+		t.CA = filepath.Join(path, "ca.pem")
+	}
+	return t
+}
+
+// readPEM reads the file at path, if one is given.
+func readPEM(what, path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading Docker TLS %s: %s", what, err)
+	}
+	return data, nil
+}
+
+func newDockerRuntime(endpoint string, tls dockerTLS) (*dockerRuntime, error) {
+	if !tls.enabled() {
+		client, err := docker.NewClient(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return &dockerRuntime{endpoint: endpoint, client: client}, nil
+	}
+
+	if (tls.Cert == "") != (tls.Key == "") {
+		return nil, fmt.Errorf("a Docker TLS client certificate needs its key and vice versa")
+	}
+	cert, err := readPEM("certificate", tls.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPEM("key", tls.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := readPEM("CA", tls.CA)
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil {
+		log.Warningf("Not verifying the certificate of the Docker daemon at %s, no CA was given", endpoint)
+	}
+	client, err := docker.NewTLSClientFromBytes(endpoint, cert, key, ca)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{endpoint: endpoint, client: client}, nil
+}
+
+// Ping checks that the daemon can be reached, so that a wrong address or
+// certificate is reported on startup rather than when the first route goes.
+func (d *dockerRuntime) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPingTimeout)
+	defer cancel()
+	if err := d.client.PingWithContext(ctx); err != nil {
+		return fmt.Errorf("could not reach the daemon at %s: %s", d.endpoint, err)
+	}
+	return nil
+}
+
+func (d *dockerRuntime) Kill(id string) error {
+	return d.client.KillContainer(docker.KillContainerOptions{
+		ID:     id,
+		Signal: docker.SIGKILL,
+	})
+}
+
+func (d *dockerRuntime) Stop(id string, timeout time.Duration) error {
+	err := d.client.StopContainer(id, uint(timeout/time.Second))
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		return nil
+	}
+	return err
+}
+
+func (d *dockerRuntime) Remove(id string, volumes bool) error {
+	err := d.client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:            id,
+		RemoveVolumes: volumes,
+		Force:         true,
+	})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
+	}
+	return err
+}
+
+func (d *dockerRuntime) Inspect(id string) (*ContainerStatus, error) {
+	container, err := d.client.InspectContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerStatus{
+		ID:      container.ID,
+		Running: container.State.Running,
+		State:   container.State.StateString(),
+	}, nil
+}
+
+func (d *dockerRuntime) Alive(id string) (bool, error) {
+	status, err := d.Inspect(id)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status.Running, nil
+}
+
+// dockerDeathEvents are the Docker event statuses after which a container can
+// no longer serve its route.
+var dockerDeathEvents = map[string]bool{
+	"die":     true,
+	"destroy": true,
+}
+
+// WatchDeaths subscribes to the Docker event stream.
+func (d *dockerRuntime) WatchDeaths(fn func(id string, event string)) error {
+	events := make(chan *docker.APIEvents, 64)
+	if err := d.client.AddEventListener(events); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			for event := range events {
+				if dockerDeathEvents[event.Status] && event.ID != "" {
+					fn(event.ID, event.Status)
+				}
+			}
+			// The client closes our channel once it gives up reconnecting
+			log.Warning("Docker event stream closed, resubscribing")
+			events = make(chan *docker.APIEvents, 64)
+			for d.client.AddEventListener(events) != nil {
+				time.Sleep(eventResubscribeDelay)
+			}
+		}
+	}()
+	return nil
+}
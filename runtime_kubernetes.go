@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts a pod's API credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesRuntime manages pods through the Kubernetes API. Container IDs
+// are pod names, optionally qualified as namespace/name.
+type kubernetesRuntime struct {
+	apiURL    string
+	namespace string
+	tokenFile string
+	client    *http.Client
+}
+
+// newKubernetesRuntime builds a runtime talking to the API server at apiURL.
+// Empty arguments fall back to the in-cluster service account configuration.
+func newKubernetesRuntime(apiURL, namespace, tokenFile, caFile string) (*kubernetesRuntime, error) {
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no Kubernetes API address given and not running in a cluster")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		namespace = strings.TrimSpace(string(data))
+		if err != nil || namespace == "" {
+			namespace = "default"
+		}
+	}
+	if tokenFile == "" {
+		if _, err := os.Stat(serviceAccountDir + "/token"); err == nil {
+			tokenFile = serviceAccountDir + "/token"
+		}
+	}
+	if caFile == "" {
+		if _, err := os.Stat(serviceAccountDir + "/ca.crt"); err == nil {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+
+	transport := &http.Transport{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubernetesRuntime{
+		apiURL:    strings.TrimRight(apiURL, "/"),
+		namespace: namespace,
+		tokenFile: tokenFile,
+		client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// kubernetesPod is the subset of a Pod object we look at.
+type kubernetesPod struct {
+	Metadata struct {
+		Name              string
+		DeletionTimestamp *time.Time
+	}
+	Status struct {
+		Phase string
+	}
+}
+
+// podURL maps a container ID to the API URL of its pod.
+func (k *kubernetesRuntime) podURL(id string) string {
+	namespace, name := k.namespace, id
+	if idx := strings.Index(id, "/"); idx != -1 {
+		namespace, name = id[:idx], id[idx+1:]
+	}
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", k.apiURL, url.PathEscape(namespace), url.PathEscape(name))
+}
+
+// do performs an API request, decoding a successful response into out if it
+// is non-nil. It returns the response status code.
+func (k *kubernetesRuntime) do(method string, target string, body interface{}, out interface{}) (int, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.tokenFile != "" {
+		// Re-read every time, projected tokens are rotated
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return res.StatusCode, nil
+	}
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("kubernetes API %s %s: %s: %s", method, target, res.Status, bytes.TrimSpace(data))
+	}
+	if out != nil {
+		return res.StatusCode, json.Unmarshal(data, out)
+	}
+	return res.StatusCode, nil
+}
+
+// deletePod deletes a pod, giving it the grace period to shut down. A pod
+// that no longer exists is not an error.
+func (k *kubernetesRuntime) deletePod(id string, grace time.Duration) error {
+	_, err := k.do("DELETE", k.podURL(id), map[string]interface{}{
+		"kind":               "DeleteOptions",
+		"apiVersion":         "v1",
+		"gracePeriodSeconds": int64(grace / time.Second),
+	}, nil)
+	return err
+}
+
+func (k *kubernetesRuntime) Kill(id string) error {
+	return k.deletePod(id, 0)
+}
+
+// Stop deletes the pod with a grace period, Kubernetes takes care of sending
+// SIGTERM and then SIGKILL.
+func (k *kubernetesRuntime) Stop(id string, timeout time.Duration) error {
+	return k.deletePod(id, timeout)
+}
+
+// Remove is a no-op, stopping a pod already deletes it along with its
+// emptyDir volumes.
+func (k *kubernetesRuntime) Remove(id string, volumes bool) error {
+	return nil
+}
+
+func (k *kubernetesRuntime) Inspect(id string) (*ContainerStatus, error) {
+	pod := &kubernetesPod{}
+	code, err := k.do("GET", k.podURL(id), nil, pod)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound {
+		return nil, fmt.Errorf("no such pod %s", id)
+	}
+	return &ContainerStatus{
+		ID:      id,
+		Running: pod.Status.Phase == "Running" && pod.Metadata.DeletionTimestamp == nil,
+		State:   pod.Status.Phase,
+	}, nil
+}
+
+// Alive considers pods still starting up alive, as well as running ones.
+func (k *kubernetesRuntime) Alive(id string) (bool, error) {
+	pod := &kubernetesPod{}
+	code, err := k.do("GET", k.podURL(id), nil, pod)
+	if err != nil || code == http.StatusNotFound {
+		return false, err
+	}
+	if pod.Metadata.DeletionTimestamp != nil {
+		return false, nil
+	}
+	return pod.Status.Phase == "Pending" || pod.Status.Phase == "Running", nil
+}
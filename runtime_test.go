@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessRuntime(t *testing.T) {
+	rt := &processRuntime{pollInterval: 10 * time.Millisecond}
+	for _, stop := range []bool{true, false} {
+		cmd := exec.Command("sleep", "60")
+		if err := cmd.Start(); err != nil {
+			t.Skip("Cannot start test process", err)
+		}
+		id := strconv.Itoa(cmd.Process.Pid)
+
+		if alive, err := rt.Alive(id); err != nil || !alive {
+			t.Fatal("Expected process to be alive", alive, err)
+		}
+		if status, err := rt.Inspect(id); err != nil || !status.Running {
+			t.Error("Expected process to be running", status, err)
+		}
+		if stop {
+			err := rt.Stop(id, time.Second)
+			if err != nil {
+				t.Error("Stopping process failed", err)
+			}
+		} else if err := rt.Kill(id); err != nil {
+			t.Error("Killing process failed", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for alive, _ := rt.Alive(id); alive && time.Now().Before(deadline); alive, _ = rt.Alive(id) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if alive, err := rt.Alive(id); err != nil || alive {
+			t.Error("Expected process to be dead", alive, err)
+		}
+		_ = cmd.Wait()
+		// Gone entirely, which is not an error
+		if err := rt.Kill(id); err != nil {
+			t.Error("Killing a dead process failed", err)
+		}
+	}
+
+	if _, err := rt.Alive("not a pid"); err == nil {
+		t.Error("Expected an error for an invalid pid")
+	}
+}
+
+func TestKubernetesRuntime(t *testing.T) {
+	var mu sync.Mutex
+	phases := map[string]string{
+		"/api/v1/namespaces/galaxy/pods/running":  "Running",
+		"/api/v1/namespaces/galaxy/pods/starting": "Pending",
+		"/api/v1/namespaces/other/pods/done":      "Succeeded",
+	}
+	deleted := map[string]float64{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		phase, ok := phases[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"metadata": map[string]string{"name": r.URL.Path},
+				"status":   map[string]string{"phase": phase},
+			})
+		case "DELETE":
+			options := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&options)
+			deleted[r.URL.Path] = options["gracePeriodSeconds"].(float64)
+			delete(phases, r.URL.Path)
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+	defer api.Close()
+
+	tokenFile := writeTempFile(t, "token\n")
+	rt, err := newKubernetesRuntime(api.URL, "galaxy", tokenFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ID    string
+		Alive bool
+	}{
+		{"running", true},
+		{"starting", true},
+		{"other/done", false},
+		{"missing", false},
+	}
+	for _, tc := range tests {
+		if alive, err := rt.Alive(tc.ID); err != nil || alive != tc.Alive {
+			t.Error("For", tc.ID, "expected alive", tc.Alive, "found", alive, err)
+		}
+	}
+	if status, err := rt.Inspect("running"); err != nil || !status.Running || status.State != "Running" {
+		t.Error("Unexpected status", status, err)
+	}
+
+	if err := rt.Stop("running", 30*time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := rt.Kill("starting"); err != nil {
+		t.Error(err)
+	}
+	if err := rt.Kill("missing"); err != nil {
+		t.Error("Killing a missing pod failed", err)
+	}
+	mu.Lock()
+	if deleted["/api/v1/namespaces/galaxy/pods/running"] != 30 || deleted["/api/v1/namespaces/galaxy/pods/starting"] != 0 || len(deleted) != 2 {
+		t.Error("Unexpected deletions", deleted)
+	}
+	mu.Unlock()
+	if alive, _ := rt.Alive("running"); alive {
+		t.Error("Deleted pod still alive")
+	}
+}
+
+// recordingRuntime remembers which containers it was asked to kill.
+type recordingRuntime struct {
+	noopRuntime
+	mu     sync.Mutex
+	killed []string
+}
+
+func (r *recordingRuntime) Kill(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.killed = append(r.killed, id)
+	return nil
+}
+
+func TestRouteRuntimeSelection(t *testing.T) {
+	docker, podman := &recordingRuntime{}, &recordingRuntime{}
+	rm := &RouteMapping{
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: docker, runtimePodman: podman},
+		DefaultRuntime: runtimeDocker,
+	}
+	a := rm.AddRoute("test", Route{FrontendPath: "/a", BackendAddr: "a", AuthorizedCookie: "c", ContainerIds: []string{"a1"}})
+	b := rm.AddRoute("test", Route{FrontendPath: "/b", BackendAddr: "b", AuthorizedCookie: "c", ContainerIds: []string{"b1"}, Runtime: runtimePodman})
+	c := rm.AddRoute("test", Route{FrontendPath: "/c", BackendAddr: "c", AuthorizedCookie: "c", ContainerIds: []string{"b1"}})
+
+	// A podman event must not take down the docker route with a
+	// coincidentally matching container ID
+	rm.handleContainerDeath(runtimePodman, "b1", "die")
+	if _, err := rm.GetRoute(b.ID); err == nil {
+		t.Error("Podman route survived its container's death")
+	}
+	if _, err := rm.GetRoute(c.ID); err != nil {
+		t.Error("Docker route was removed by a podman event")
+	}
+	rm.RemoveRoute("test", a, "test")
+	rm.WaitTeardowns()
+
+	if len(docker.killed) != 1 || docker.killed[0] != "a1" {
+		t.Error("Docker runtime killed", docker.killed)
+	}
+	if len(podman.killed) != 1 || podman.killed[0] != "b1" {
+		t.Error("Podman runtime killed", podman.killed)
+	}
+	if !rm.HasRuntime("") || !rm.HasRuntime(runtimePodman) || rm.HasRuntime(runtimeKubernetes) {
+		t.Error("HasRuntime disagrees with configured runtimes")
+	}
+}
+
+func TestProcessRuntimeOptIn(t *testing.T) {
+	for _, cfg := range []struct {
+		runtimeConfig
+		expected bool
+	}{
+		{runtimeConfig{Default: runtimeNone}, false},
+		{runtimeConfig{Default: runtimeNone, AllowProcess: true}, true},
+		{runtimeConfig{Default: runtimeProcess}, true},
+	} {
+		runtimes, err := newContainerRuntimes(cfg.runtimeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := runtimes[runtimeProcess]; ok != cfg.expected {
+			t.Errorf("Process runtime available with %+v: %v", cfg.runtimeConfig, ok)
+		}
+	}
+}
+
+func TestDockerTLS(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	tests := []struct {
+		Flags    dockerTLS
+		Env      map[string]string
+		Expected dockerTLS
+	}{
+		{dockerTLS{}, nil, dockerTLS{}},
+		{dockerTLS{}, map[string]string{"DOCKER_TLS_VERIFY": "1", "HOME": "/home/galaxy"},
+			dockerTLS{"/home/galaxy/.docker/cert.pem", "/home/galaxy/.docker/key.pem", "/home/galaxy/.docker/ca.pem"}},
+		{dockerTLS{}, map[string]string{"DOCKER_CERT_PATH": "/certs"}, dockerTLS{"/certs/cert.pem", "/certs/key.pem", ""}},
+		{dockerTLS{CA: "ca.pem"}, map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": "/certs"}, dockerTLS{CA: "ca.pem"}},
+	}
+	for _, tc := range tests {
+		if got := tc.Flags.withEnv(env(tc.Env)); got != tc.Expected {
+			t.Errorf("%+v with %v gave %+v", tc.Flags, tc.Env, got)
+		}
+	}
+
+	if _, err := newDockerRuntime("tcp://127.0.0.1:2376", dockerTLS{Cert: "cert.pem"}); err == nil {
+		t.Error("A certificate without a key was accepted")
+	}
+	if _, err := newDockerRuntime("tcp://127.0.0.1:2376", dockerTLS{CA: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("A missing CA was ignored")
+	}
+
+	daemon := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer daemon.Close()
+	endpoint := "tcp://" + daemon.Listener.Addr().String()
+	ca := writeTempFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: daemon.Certificate().Raw})))
+	rt, err := newDockerRuntime(endpoint, dockerTLS{CA: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Ping(); err != nil {
+		t.Error("Could not reach the daemon", err)
+	}
+
+	_, err = newContainerRuntimes(runtimeConfig{Default: runtimeDocker, DockerEndpoint: endpoint})
+	if err == nil || !strings.Contains(err.Error(), "could not reach") {
+		t.Error("Unreachable default daemon was not reported", err)
+	}
+}
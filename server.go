@@ -1,10 +1,48 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
+	"sync/atomic"
 )
 
 func (f *frontend) Start(rm *RouteMapping) {
+	go f.watchRuntime(rm)
+	if f.AdminAddr != "" {
+		startAdmin(f.AdminAddr, f.adminHandler(rm))
+	}
+	// Here we then launch the server from mux
+	srv := &http.Server{Handler: f.handler(rm), Addr: f.Addr}
+	// Start
+	log.Infof("Listening on %s %s", f.Addr, f.Path)
+	l, err := net.Listen("tcp", f.Addr)
+	if err == nil {
+		atomic.StoreInt32(&f.listening, 1)
+		if f.TLS != nil {
+			srv.TLSConfig = f.tlsConfig()
+			f.TLS.Watch(certPollInterval)
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		atomic.StoreInt32(&f.listening, 0)
+	}
+	if err != nil {
+		log.Criticalf("Starting frontend failed: %v", err)
+	}
+}
+
+// tlsConfig serves the frontend's certificates, chosen by SNI.
+func (f *frontend) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: f.TLS.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// handler routes requests to the API and to the proxied routes.
+func (f *frontend) handler(rm *RouteMapping) http.Handler {
 	mux := http.NewServeMux()
 
 	// Main request handler, processes every incoming request
@@ -12,6 +50,7 @@ func (f *frontend) Start(rm *RouteMapping) {
 		Transport: &http.Transport{
 			DisableKeepAlives:  false,
 			DisableCompression: false,
+			DialContext:        rm.Failures.dialContext,
 		},
 		RouteMapping: rm,
 		Frontend:     f,
@@ -31,14 +70,25 @@ func (f *frontend) Start(rm *RouteMapping) {
 	// unavailable to external access, and only available from localhost. This
 	// is a win for security, as only Galaxy should be talking to the API
 	mux.Handle("/api", apiHandler)
+	// Individual routes are addressed under /api/routes/{id}
+	mux.Handle("/api/", apiHandler)
+	if f.AdminAddr == "" {
+		f.handleHealth(mux, rm)
+	}
 	// The slash route handles ALL requests by passing to the request_handler
 	// object
 	mux.Handle("/", requestHandler)
-	// Here we then launch the server from mux
-	srv := &http.Server{Handler: mux, Addr: f.Addr}
-	// Start
-	log.Info("Listening on %s %s", f.Addr, f.Path)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Critical("Starting frontend failed: %v", err)
+	// Hosts of host routes are served by their IEs alone, which may well
+	// have an /api of their own, unless the API is reached by that host
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.isAPIHost(r.Host) && rm.ServesHost(r.Host) {
+			requestHandler.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	if f.TLS != nil && f.HSTS > 0 {
+		return strictTransport(f.HSTS, handler)
 	}
+	return handler
 }
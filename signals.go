@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onHangup runs fn every time the process receives SIGHUP, which is how
+// operators ask us to reload files from disk.
+func onHangup(fn func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			fn()
+		}
+	}()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteStore persists routes across restarts. RouteMapping writes every
+// change through to it as it happens, so implementations are free to store
+// routes individually.
+type RouteStore interface {
+	// Load returns every stored route.
+	Load() ([]Route, error)
+	// Put stores routes, replacing those stored under the same ID.
+	Put(routes ...Route) error
+	// Delete removes the routes with the given IDs. Unknown IDs are ignored.
+	Delete(ids ...string) error
+	// Close releases the store.
+	Close() error
+}
+
+// Storage URL schemes
+const (
+	// storageXML rewrites a single XML file on every change
+	storageXML = "xml"
+	// storageBolt keeps routes in an embedded bbolt database
+	storageBolt = "bolt"
+	// storageRedis shares routes between several proxies through Redis
+	storageRedis = "redis"
+)
+
+// parseStorageURL splits a storage URL such as bolt:///var/lib/gie/routes.db
+// into its scheme and path. A plain path selects the XML file store.
+func parseStorageURL(storage string) (scheme string, path string) {
+	idx := strings.Index(storage, "://")
+	if idx < 0 {
+		return storageXML, storage
+	}
+	return storage[:idx], storage[idx+len("://"):]
+}
+
+// openStore opens the RouteStore described by the Storage URL.
+func (rm *RouteMapping) openStore() (RouteStore, error) {
+	scheme, path := parseStorageURL(rm.Storage)
+	if path == "" {
+		return nil, fmt.Errorf("storage %s has no path", rm.Storage)
+	}
+	switch scheme {
+	case storageXML:
+		return newXMLStore(path, rm.StorageBackups, routeMappingFile{
+			AuthCookieName:    rm.AuthCookieName,
+			Storage:           rm.Storage,
+			NoAccessThreshold: rm.NoAccessThreshold,
+			DockerEndpoint:    rm.DockerEndpoint,
+			CleanInterval:     rm.CleanInterval,
+		}), nil
+	case storageBolt:
+		return newBoltStore(path)
+	case storageRedis:
+		return newRedisStore(rm.Storage)
+	}
+	return nil, fmt.Errorf("unknown storage scheme %s, expected %s://, %s:// or %s://", scheme, storageXML, storageBolt, storageRedis)
+}
+
+// restore loads the routes from the store, then brings the store in line
+// with what was kept: routes from before IDs existed are given one, and of
+// several routes for the same cookie and path only the last survives.
+func (rm *RouteMapping) restore() error {
+	if rm.Store == nil {
+		rm.setRoutes(nil)
+		return nil
+	}
+	routes, err := rm.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+	rm.setRoutes(routes)
+
+	loaded := make(map[string]bool)
+	var stale []string
+	for _, route := range routes {
+		if route.ID == "" {
+			// Stored without an ID, replaced by the copy stored below
+			if !loaded[""] {
+				loaded[""] = true
+				stale = append(stale, "")
+			}
+			continue
+		}
+		loaded[route.ID] = true
+		if _, err := rm.GetRoute(route.ID); err != nil {
+			stale = append(stale, route.ID)
+		}
+	}
+	var fresh []*Route
+	rm.mu.RLock()
+	for _, route := range rm.routes {
+		if !loaded[route.ID] {
+			fresh = append(fresh, route)
+		}
+	}
+	rm.mu.RUnlock()
+	rm.persist(fresh, stale)
+	return nil
+}
+
+// Save stores the routes which have seen traffic since they were last
+// stored, so that their activity survives a restart.
+func (rm *RouteMapping) Save() {
+	rm.storeMu.Lock()
+	defer rm.storeMu.Unlock()
+
+	var changed []*Route
+	rm.mu.RLock()
+	for _, route := range rm.routes {
+		if route.live.unsaved() {
+			changed = append(changed, route)
+		}
+	}
+	rm.mu.RUnlock()
+	rm.persist(changed, nil)
+}
+
+// persist writes added or changed routes to the store and deletes removed
+// ones. Errors are logged only, the in-memory mapping stays authoritative.
+// The caller must hold rm.storeMu, and must have taken it before changing
+// the mapping so that writes reach the store in the same order.
+func (rm *RouteMapping) persist(put []*Route, deleted []string) {
+	if rm.Store == nil {
+		return
+	}
+	if len(deleted) > 0 {
+		if err := rm.Store.Delete(deleted...); err != nil {
+			log.Errorf("Could not delete routes from storage: %s", err)
+		}
+	}
+	if len(put) == 0 {
+		return
+	}
+	routes := make([]Route, len(put))
+	for idx, route := range put {
+		routes[idx] = route.snapshot()
+	}
+	if err := rm.Store.Put(routes...); err != nil {
+		log.Errorf("Could not write routes to storage: %s", err)
+		return
+	}
+	for idx, route := range put {
+		route.live.markStored(routes[idx].LastSeen.UnixNano())
+	}
+}
+
+// unsaved reports whether the route was accessed after it was last stored.
+func (s *routeState) unsaved() bool {
+	return atomic.LoadInt64(&s.seen) != atomic.LoadInt64(&s.stored)
+}
+
+// markStored records the last access time that was written to storage.
+func (s *routeState) markStored(seen int64) {
+	atomic.StoreInt64(&s.stored, seen)
+}
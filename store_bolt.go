@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltRoutesBucket holds the routes as JSON, keyed by route ID.
+var boltRoutesBucket = []byte("routes")
+
+// boltStore keeps routes in an embedded bbolt database, one key per route,
+// so a change only writes the routes it touches.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens, or creates, the database at path. The file is locked
+// while open, so a second proxy using it fails to start rather than
+// corrupting it.
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRoutesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Load returns every stored route, ordered by ID.
+func (s *boltStore) Load() ([]Route, error) {
+	var routes []Route
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoutesBucket).ForEach(func(k, v []byte) error {
+			var route Route
+			if err := json.Unmarshal(v, &route); err != nil {
+				return fmt.Errorf("route %s: %s", k, err)
+			}
+			route.ID = string(k)
+			routes = append(routes, route)
+			return nil
+		})
+	})
+	return routes, err
+}
+
+// Put upserts the routes in a single transaction.
+func (s *boltStore) Put(routes ...Route) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRoutesBucket)
+		for _, route := range routes {
+			data, err := json.Marshal(route)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(route.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the routes in a single transaction.
+func (s *boltStore) Delete(ids ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRoutesBucket)
+		for _, id := range ids {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the database, releasing its lock.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
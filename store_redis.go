@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Defaults for redis:// storage URLs
+const (
+	// redisDefaultPrefix namespaces every key, so several proxies sharing a
+	// Redis can be kept apart with ?prefix=
+	redisDefaultPrefix = "gie-proxy:"
+	// redisDefaultLease is how long the cleaner lease is held without being
+	// renewed, overridden with ?lease=
+	redisDefaultLease = 15 * time.Second
+)
+
+// redisRenewLease takes the lease if it is free, or extends it if we already
+// hold it. Returns 1 if we hold the lease afterwards.
+var redisRenewLease = redis.NewScript(1, `
+local holder = redis.call('GET', KEYS[1])
+if holder == false then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// redisReleaseLease gives up the lease, if we hold it.
+var redisReleaseLease = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// redisStore keeps routes in a Redis hash, one field per route ID, and
+// publishes every change so that the other proxies using it can follow
+// along. It also elects a single proxy to run the cleaner, through a lease
+// which is renewed in the background.
+type redisStore struct {
+	pool   *redis.Pool
+	prefix string
+	lease  time.Duration
+	// origin identifies this proxy in published changes and as the lease
+	// holder.
+	origin string
+
+	mu         sync.Mutex
+	leaseUntil time.Time
+	subscriber redis.Conn
+	closed     bool
+	done       chan struct{}
+}
+
+// newRedisStore connects to the Redis at rawurl, e.g.
+// redis://:password@localhost:6379/0?prefix=gie-proxy:&lease=15s
+func newRedisStore(rawurl string) (*redisStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisStore{
+		prefix: redisDefaultPrefix,
+		lease:  redisDefaultLease,
+		done:   make(chan struct{}),
+	}
+	query := u.Query()
+	if prefix := query.Get("prefix"); prefix != "" {
+		s.prefix = prefix
+	}
+	if lease := query.Get("lease"); lease != "" {
+		if s.lease, err = time.ParseDuration(lease); err != nil || s.lease <= 0 {
+			return nil, fmt.Errorf("invalid lease %s", lease)
+		}
+	}
+	u.RawQuery = ""
+	addr := u.String()
+
+	s.pool = &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(addr)
+		},
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	s.origin = hex.EncodeToString(buf)
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		s.pool.Close()
+		return nil, fmt.Errorf("connecting to %s: %s", u.Host, err)
+	}
+	s.renewLease()
+	go s.keepLease()
+	return s, nil
+}
+
+func (s *redisStore) routesKey() string {
+	return s.prefix + "routes"
+}
+
+func (s *redisStore) changesKey() string {
+	return s.prefix + "changes"
+}
+
+func (s *redisStore) leaseKey() string {
+	return s.prefix + "cleaner"
+}
+
+// Load returns every stored route.
+func (s *redisStore) Load() ([]Route, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	stored, err := redis.StringMap(conn.Do("HGETALL", s.routesKey()))
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Route, 0, len(stored))
+	for id, data := range stored {
+		var route Route
+		if err := json.Unmarshal([]byte(data), &route); err != nil {
+			return nil, fmt.Errorf("route %s: %s", id, err)
+		}
+		route.ID = id
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Put stores the routes and announces them, in a single transaction.
+func (s *redisStore) Put(routes ...Route) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for idx := range routes {
+		data, err := json.Marshal(routes[idx])
+		if err != nil {
+			return err
+		}
+		change, err := json.Marshal(routeChange{Origin: s.origin, Op: routeChangePut, Route: &routes[idx]})
+		if err != nil {
+			return err
+		}
+		if err := conn.Send("HSET", s.routesKey(), routes[idx].ID, data); err != nil {
+			return err
+		}
+		if err := conn.Send("PUBLISH", s.changesKey(), change); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Delete removes the routes and announces it, in a single transaction.
+func (s *redisStore) Delete(ids ...string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		change, err := json.Marshal(routeChange{Origin: s.origin, Op: routeChangeDelete, ID: id})
+		if err != nil {
+			return err
+		}
+		if err := conn.Send("HDEL", s.routesKey(), id); err != nil {
+			return err
+		}
+		if err := conn.Send("PUBLISH", s.changesKey(), change); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// WatchRoutes follows the changes published by other proxies. Whenever the
+// subscription is (re)established, fn is first asked to sync, to catch up on
+// changes made while it was down.
+func (s *redisStore) WatchRoutes(fn func(change routeChange)) error {
+	go func() {
+		for {
+			err := s.subscribe(fn)
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Warningf("Lost subscription to route changes, resubscribing in %s: %s", eventResubscribeDelay, err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(eventResubscribeDelay):
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe receives changes until the subscription fails or the store is
+// closed.
+func (s *redisStore) subscribe(fn func(change routeChange)) error {
+	// Not from the pool, Close is used to interrupt Receive
+	conn, err := s.pool.Dial()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.subscriber = conn
+	s.mu.Unlock()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(s.changesKey()); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Kind != "subscribe" {
+				continue
+			}
+			// Changes are only received from now on, so catch up
+			fn(routeChange{Op: routeChangeSync})
+		case redis.Message:
+			var change routeChange
+			if err := json.Unmarshal(v.Data, &change); err != nil {
+				log.Warningf("Ignoring malformed route change: %s", err)
+				continue
+			}
+			if change.Origin != s.origin {
+				fn(change)
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// HoldsLease reports whether this proxy currently holds the cleaner lease.
+func (s *redisStore) HoldsLease() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.leaseUntil)
+}
+
+// keepLease takes or renews the cleaner lease at a third of its duration,
+// so it survives two failed attempts.
+func (s *redisStore) keepLease() {
+	ticker := time.NewTicker(s.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.renewLease()
+		}
+	}
+}
+
+func (s *redisStore) renewLease() {
+	// The lease is only counted from before asking for it
+	start := time.Now()
+	conn := s.pool.Get()
+	defer conn.Close()
+	held, err := redis.Int(redisRenewLease.Do(conn, s.leaseKey(), s.origin, int64(s.lease/time.Millisecond)))
+	if err != nil {
+		log.Warningf("Could not renew the cleaner lease: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wasHeld := time.Now().Before(s.leaseUntil)
+	if held == 1 {
+		s.leaseUntil = start.Add(s.lease)
+	} else if err == nil {
+		s.leaseUntil = time.Time{}
+	}
+	// On errors the lease runs out by itself
+	if isHeld := time.Now().Before(s.leaseUntil); isHeld != wasHeld {
+		if isHeld {
+			log.Infof("Acquired the cleaner lease, this proxy now removes expired routes")
+		} else {
+			log.Infof("Lost the cleaner lease to another proxy")
+		}
+	}
+}
+
+// Close stops following changes and gives up the cleaner lease, so another
+// proxy can take over straight away.
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.subscriber != nil {
+		s.subscriber.Close()
+	}
+	s.leaseUntil = time.Time{}
+	s.mu.Unlock()
+
+	conn := s.pool.Get()
+	_, err := redisReleaseLease.Do(conn, s.leaseKey(), s.origin)
+	conn.Close()
+	s.pool.Close()
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// eventually polls cond until it holds or a second has passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisStoreReplicas(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Two proxies sharing the store, each with their own runtime
+	replica := func() (*RouteMapping, *recordingRuntime) {
+		rt := &recordingRuntime{}
+		rm := &RouteMapping{
+			Storage:           "redis://" + server.Addr() + "?lease=300ms",
+			NoAccessThreshold: time.Hour,
+			Runtimes:          map[string]ContainerRuntime{runtimeDocker: rt},
+			DefaultRuntime:    runtimeDocker,
+		}
+		if rm.Store, err = rm.openStore(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.restore(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.WatchStore(); err != nil {
+			t.Fatal(err)
+		}
+		return rm, rt
+	}
+	a, aRuntime := replica()
+	defer a.Store.Close()
+	b, bRuntime := replica()
+	defer b.Store.Close()
+
+	if !a.holdsCleanerLease() || b.holdsCleanerLease() {
+		t.Fatal("Expected only the first proxy to hold the cleaner lease")
+	}
+
+	// Additions and updates are seen by the other proxy
+	added := a.AddRoute("test", Route{FrontendPath: "/ipython", BackendAddr: "a", AuthorizedCookie: "c", ContainerIds: []string{"a1"}})
+	eventually(t, "the route to be added", func() bool {
+		route, err := b.FindRoute("/ipython/", "c")
+		return err == nil && route.ID == added.ID
+	})
+	if _, err := b.UpdateRoute("test", added.ID, Route{FrontendPath: "/ipython", BackendAddr: "b", AuthorizedCookie: "c", ContainerIds: []string{"a1"}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the route to be updated", func() bool {
+		route, err := a.GetRoute(added.ID)
+		return err == nil && route.BackendAddr == "b"
+	})
+
+	// Traffic through either proxy keeps the route alive
+	route, _ := b.GetRoute(added.ID)
+	route.Seen()
+	lastSeen := route.LastAccess()
+	b.RemoveDeadContainers()
+	eventually(t, "activity to be shared", func() bool {
+		route, err := a.GetRoute(added.ID)
+		return err == nil && route.LastAccess().Equal(lastSeen)
+	})
+
+	// Removals too, but only the removing proxy touches the containers
+	a.RemoveRoute("test", added, "test")
+	eventually(t, "the route to be removed", func() bool {
+		return b.Len() == 0
+	})
+	a.WaitTeardowns()
+	b.WaitTeardowns()
+	if len(aRuntime.killed) != 1 || len(bRuntime.killed) != 0 {
+		t.Error("Expected one kill by the removing proxy, found", aRuntime.killed, bRuntime.killed)
+	}
+	if removals := b.Removals(); len(removals) != 1 || removals[0].Route.ID != added.ID {
+		t.Error("Removal was not recorded", removals)
+	}
+
+	// A proxy joining later starts from the shared routes
+	a.AddRoute("test", Route{FrontendPath: "/rstudio", BackendAddr: "a", AuthorizedCookie: "c"})
+	c, _ := replica()
+	defer c.Store.Close()
+	if c.Len() != 1 {
+		t.Error("Expected the new proxy to restore 1 route, found", c.Len())
+	}
+
+	// The lease passes on once its holder goes away
+	a.Store.Close()
+	eventually(t, "the lease to pass on", func() bool {
+		return b.holdsCleanerLease() != c.holdsCleanerLease()
+	})
+}
+
+func TestRedisStoreReplicasProbe(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var up int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	replica := func(probeInterval time.Duration) *RouteMapping {
+		rm := &RouteMapping{
+			Storage:           "redis://" + server.Addr(),
+			NoAccessThreshold: time.Hour,
+			ProbeInterval:     probeInterval,
+		}
+		if rm.Store, err = rm.openStore(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.restore(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.WatchStore(); err != nil {
+			t.Fatal(err)
+		}
+		return rm
+	}
+	// The adding proxy checks only once in a while
+	a := replica(time.Hour)
+	defer a.Store.Close()
+	b := replica(10 * time.Millisecond)
+	defer b.Store.Close()
+
+	added := a.AddRoute("test", Route{FrontendPath: "/ipython", BackendAddr: backend.Listener.Addr().String(), HealthPath: "/", AuthorizedCookie: "c"})
+	eventually(t, "the route to be added", func() bool {
+		_, err := b.GetRoute(added.ID)
+		return err == nil
+	})
+	atomic.StoreInt32(&up, 1)
+	eventually(t, "the other proxy to find the backend ready", func() bool {
+		route, err := a.GetRoute(added.ID)
+		return err == nil && route.IsReady()
+	})
+}
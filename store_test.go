@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStorageURL(t *testing.T) {
+	cases := []struct {
+		storage, scheme, path string
+	}{
+		{"./sessionMap.xml", storageXML, "./sessionMap.xml"},
+		{"xml:///var/lib/gie/sessionMap.xml", storageXML, "/var/lib/gie/sessionMap.xml"},
+		{"bolt://routes.db", storageBolt, "routes.db"},
+	}
+	for _, c := range cases {
+		scheme, path := parseStorageURL(c.storage)
+		if scheme != c.scheme || path != c.path {
+			t.Error("Parsed", c.storage, "as", scheme, path)
+		}
+	}
+
+	rm := &RouteMapping{Storage: "etcd://localhost"}
+	if _, err := rm.openStore(); err == nil {
+		t.Error("Expected an error for an unknown scheme")
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := &RouteMapping{Storage: "bolt://" + filepath.Join(dir, "routes.db")}
+	if rm.Store, err = rm.openStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.restore(); err != nil {
+		t.Fatal(err)
+	}
+	kept := rm.AddRoute("test", Route{FrontendPath: "/kept", BackendAddr: "a", AuthorizedCookie: "c"})
+	replaced := rm.AddRoute("test", Route{FrontendPath: "/replaced", BackendAddr: "a", AuthorizedCookie: "c"})
+	replacement := rm.AddRoute("test", Route{FrontendPath: "/replaced", BackendAddr: "b", AuthorizedCookie: "c"})
+	removed := rm.AddRoute("test", Route{FrontendPath: "/removed", BackendAddr: "a", AuthorizedCookie: "c"})
+	if _, err := rm.UpdateRoute("test", kept.ID, Route{FrontendPath: "/kept", BackendAddr: "updated", AuthorizedCookie: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	rm.RemoveRoute("test", removed, "test")
+
+	// Activity is only written by Save
+	active, _ := rm.GetRoute(replacement.ID)
+	active.Seen()
+	lastSeen := active.LastAccess()
+	rm.Save()
+	if err := rm.Store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &RouteMapping{}
+	if restored.Store, err = newBoltStore(filepath.Join(dir, "routes.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Store.Close()
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 2 {
+		t.Error("Expected 2 routes, found", restored.Snapshot())
+	}
+	if _, err := restored.GetRoute(replaced.ID); err == nil {
+		t.Error("Replaced route was restored")
+	}
+	if route, err := restored.GetRoute(kept.ID); err != nil || route.BackendAddr != "updated" {
+		t.Error("Update was not stored", route, err)
+	}
+	if route, err := restored.GetRoute(replacement.ID); err != nil || !route.LastAccess().Equal(lastSeen) {
+		t.Error("Activity was not stored", route, err)
+	}
+}
+
+func TestRestoreLegacyRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessionMap.xml")
+
+	// Routes from before IDs existed, one of them shadowed by a later one
+	legacy := newXMLStore(path, 0, routeMappingFile{})
+	lastSeen := time.Now().Add(-time.Minute).Round(time.Second)
+	for _, backend := range []string{"old", "new"} {
+		legacy.routes = append(legacy.routes, Route{FrontendPath: "/ipython", BackendAddr: backend, AuthorizedCookie: "c", LastSeen: lastSeen})
+	}
+	if err := legacy.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	rm := &RouteMapping{Store: newXMLStore(path, 0, routeMappingFile{})}
+	if err := rm.restore(); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newXMLStore(path, 0, routeMappingFile{}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].ID == "" || routes[0].BackendAddr != "new" || !routes[0].LastSeen.Equal(lastSeen) {
+		t.Error("Expected the surviving route to be stored with an ID, found", routes)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TeardownPolicy describes how the containers of a removed route are shut
+// down.
+type TeardownPolicy struct {
+	// GracePeriod is how many seconds containers are given to exit after
+	// being asked to stop (SIGTERM) before they are killed. Zero kills them
+	// straight away.
+	GracePeriod int
+	// Remove deletes the containers once they have stopped.
+	Remove bool
+	// RemoveVolumes also deletes the containers' anonymous volumes.
+	RemoveVolumes bool
+}
+
+// policyFor returns the teardown policy applying to a route.
+func (rm *RouteMapping) policyFor(r *Route) TeardownPolicy {
+	if r.Teardown != nil {
+		return *r.Teardown
+	}
+	return rm.Teardown
+}
+
+// retireLocked records the removal of a route, returning the record which
+// its teardown will add any errors to. The caller must hold rm.mu for
+// writing.
+func (rm *RouteMapping) retireLocked(route *Route, reason string) *RouteRemoval {
+	removal := &RouteRemoval{
+		Route:  route.snapshot(),
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	rm.removals = append(rm.removals, removal)
+	if len(rm.removals) > maxRemovals {
+		rm.removals = rm.removals[len(rm.removals)-maxRemovals:]
+	}
+	return removal
+}
+
+// startTeardown shuts down the given containers of a removed route in the
+// background, recording any errors in its removal record.
+func (rm *RouteMapping) startTeardown(route *Route, containers []string, removal *RouteRemoval) {
+	if len(containers) == 0 {
+		return
+	}
+	rm.teardowns.Add(1)
+	go func() {
+		defer rm.teardowns.Done()
+		errs := rm.teardownContainers(route, containers)
+		if len(errs) > 0 {
+			rm.mu.Lock()
+			removal.Errors = errs
+			rm.mu.Unlock()
+		}
+	}()
+}
+
+// WaitTeardowns blocks until every teardown in progress has finished.
+func (rm *RouteMapping) WaitTeardowns() {
+	// Removals start their teardown before releasing storeMu, so one which
+	// already took the route out of the map is waited for too
+	rm.storeMu.Lock()
+	rm.storeMu.Unlock()
+	rm.teardowns.Wait()
+}
+
+// teardownContainers applies the route's teardown policy to each container
+// in parallel, returning a description of every step that failed.
+func (rm *RouteMapping) teardownContainers(route *Route, containers []string) []string {
+	rt := rm.runtimeFor(route)
+	policy := rm.policyFor(route)
+
+	var mu sync.Mutex
+	var errs []string
+	record := func(step string, id string, err error) {
+		routeFields(route).err(err).Warningf("Error during %s of container %s", step, id)
+		mu.Lock()
+		errs = append(errs, fmt.Sprintf("%s %s: %s", step, id, err))
+		mu.Unlock()
+		metrics.teardownFailed(step)
+	}
+
+	var wg sync.WaitGroup
+	for _, containerID := range containers {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			killed := false
+			if policy.GracePeriod > 0 {
+				log.Infof("Stopping %s", id)
+				err := rt.Stop(id, time.Duration(policy.GracePeriod)*time.Second)
+				if err == nil {
+					killed = true
+				} else {
+					record("stop", id, err)
+				}
+			}
+			if !killed {
+				log.Infof("Killing %s", id)
+				if err := rt.Kill(id); err != nil {
+					record("kill", id, err)
+				}
+			}
+			if policy.Remove {
+				log.Infof("Removing %s", id)
+				if err := rt.Remove(id, policy.RemoveVolumes); err != nil {
+					record("remove", id, err)
+				}
+			}
+		}(containerID)
+	}
+	wg.Wait()
+	return errs
+}
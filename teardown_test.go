@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedRuntime records every call made to it, failing the steps listed
+// in fail.
+type scriptedRuntime struct {
+	noopRuntime
+	fail map[string]bool
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *scriptedRuntime) step(call string, step string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+	if s.fail[step] {
+		return errors.New(step + " failed")
+	}
+	return nil
+}
+
+func (s *scriptedRuntime) Kill(id string) error {
+	return s.step("kill "+id, "kill")
+}
+
+func (s *scriptedRuntime) Stop(id string, timeout time.Duration) error {
+	return s.step("stop "+id+" "+timeout.String(), "stop")
+}
+
+func (s *scriptedRuntime) Remove(id string, volumes bool) error {
+	if volumes {
+		return s.step("remove "+id+" with volumes", "remove")
+	}
+	return s.step("remove "+id, "remove")
+}
+
+func (s *scriptedRuntime) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := append([]string(nil), s.calls...)
+	sort.Strings(calls)
+	return calls
+}
+
+func TestTeardownPolicy(t *testing.T) {
+	tests := []struct {
+		Policy         TeardownPolicy
+		Fail           map[string]bool
+		ExpectedCalls  []string
+		ExpectedErrors []string
+	}{
+		{
+			Policy:        TeardownPolicy{},
+			ExpectedCalls: []string{"kill a"},
+		},
+		{
+			Policy:        TeardownPolicy{GracePeriod: 30},
+			ExpectedCalls: []string{"stop a 30s"},
+		},
+		{
+			Policy:        TeardownPolicy{GracePeriod: 5, Remove: true, RemoveVolumes: true},
+			ExpectedCalls: []string{"remove a with volumes", "stop a 5s"},
+		},
+		{
+			Policy:         TeardownPolicy{GracePeriod: 5, Remove: true},
+			Fail:           map[string]bool{"stop": true, "remove": true},
+			ExpectedCalls:  []string{"kill a", "remove a", "stop a 5s"},
+			ExpectedErrors: []string{"remove a: remove failed", "stop a: stop failed"},
+		},
+		{
+			Policy:         TeardownPolicy{},
+			Fail:           map[string]bool{"kill": true},
+			ExpectedCalls:  []string{"kill a"},
+			ExpectedErrors: []string{"kill a: kill failed"},
+		},
+	}
+
+	for _, tc := range tests {
+		rt := &scriptedRuntime{fail: tc.Fail}
+		rm := &RouteMapping{
+			Runtimes:       map[string]ContainerRuntime{runtimeDocker: rt},
+			DefaultRuntime: runtimeDocker,
+			Teardown:       tc.Policy,
+		}
+		route := rm.AddRoute("test", Route{FrontendPath: "/a", BackendAddr: "a", AuthorizedCookie: "c", ContainerIds: []string{"a"}})
+		rm.RemoveRoute("test", route, "test")
+		rm.WaitTeardowns()
+
+		if calls := rt.Calls(); !reflect.DeepEqual(calls, tc.ExpectedCalls) {
+			t.Error("For", tc.Policy, "expected calls", tc.ExpectedCalls, "found", calls)
+		}
+		errs := rm.Removals()[0].Errors
+		sort.Strings(errs)
+		if len(errs) != len(tc.ExpectedErrors) || (len(errs) > 0 && !reflect.DeepEqual(errs, tc.ExpectedErrors)) {
+			t.Error("For", tc.Policy, "expected errors", tc.ExpectedErrors, "found", errs)
+		}
+	}
+}
+
+func TestTeardownPolicyPerRoute(t *testing.T) {
+	rt := &scriptedRuntime{}
+	rm := &RouteMapping{
+		Runtimes:       map[string]ContainerRuntime{runtimeDocker: rt},
+		DefaultRuntime: runtimeDocker,
+		Teardown:       TeardownPolicy{GracePeriod: 10},
+	}
+	ts := httptest.NewServer(&apiHandler{RouteMapping: rm, Frontend: &frontend{APIKeys: testKeyring()}})
+	defer ts.Close()
+
+	data, code, err := post(ts, "/api/routes?api_key=supersecret", []byte(`{
+		"FrontendPath": "/a", "BackendAddr": "a", "AuthorizedCookie": "c", "ContainerIds": ["a"],
+		"Teardown": {"GracePeriod": 60, "Remove": true}
+	}`))
+	if err != nil || code != 201 {
+		t.Fatal("Creating route returned", code, data, err)
+	}
+	rm.AddRoute("test", Route{FrontendPath: "/b", BackendAddr: "b", AuthorizedCookie: "c", ContainerIds: []string{"b"}})
+
+	for _, route := range rm.Snapshot() {
+		rm.RemoveRoute("test", &route, "test")
+	}
+	rm.WaitTeardowns()
+
+	expected := []string{"remove a", "stop a 1m0s", "stop b 10s"}
+	if calls := rt.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Error("Expected calls", expected, "found", calls)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often certificate files are checked for changes,
+// so renewed certificates are picked up without a SIGHUP.
+const certPollInterval = 30 * time.Second
+
+// certPair is a certificate file and the file holding its private key.
+type certPair struct {
+	Cert string
+	Key  string
+}
+
+// certStore holds the certificates the frontend serves, choosing between
+// them by the name clients ask for (SNI). Certificates loaded from files can
+// be reloaded at runtime; connections already established, such as open
+// websockets, carry on with the certificate they were made with.
+type certStore struct {
+	pairs []certPair
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	// modified is when each file was last changed, as of the last load.
+	modified map[string]time.Time
+}
+
+// newCertStore loads the given certificates. Without any, and if selfSigned
+// is set, it generates a certificate for this machine instead, which
+// browsers will warn about: it is only meant for development.
+func newCertStore(pairs []certPair, selfSigned bool) (*certStore, error) {
+	s := &certStore{pairs: pairs}
+	if len(pairs) > 0 {
+		return s, s.Reload()
+	}
+	if !selfSigned {
+		return nil, errors.New("no certificates given")
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	certPEM, keyPEM, err := selfSignedPEM(hosts, 365*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificate(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	s.certs = []*tls.Certificate{cert}
+	log.Warningf("Serving a self-signed certificate for %s", strings.Join(hosts, ", "))
+	return s, nil
+}
+
+// loadCertificates pairs up the --tlsCert and --tlsKey flags and loads them,
+// reloading them on SIGHUP.
+func loadCertificates(certs, keys []string, selfSigned bool) (*certStore, error) {
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("%d certificates were given with %d keys", len(certs), len(keys))
+	}
+	pairs := make([]certPair, len(certs))
+	for idx := range certs {
+		pairs[idx] = certPair{Cert: certs[idx], Key: keys[idx]}
+	}
+	s, err := newCertStore(pairs, selfSigned)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) > 0 {
+		onHangup(func() {
+			if err := s.Reload(); err != nil {
+				log.Errorf("Could not reload TLS certificates, keeping the old ones: %s", err)
+			}
+		})
+	}
+	return s, nil
+}
+
+// Reload re-reads every certificate file. On error the current certificates
+// are kept.
+func (s *certStore) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.pairs))
+	modified := make(map[string]time.Time)
+	for _, pair := range s.pairs {
+		for _, path := range []string{pair.Cert, pair.Key} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			modified[path] = info.ModTime()
+		}
+		certPEM, err := ioutil.ReadFile(pair.Cert)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := ioutil.ReadFile(pair.Key)
+		if err != nil {
+			return err
+		}
+		cert, err := parseCertificate(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("loading certificate %s: %s", pair.Cert, err)
+		}
+		certs = append(certs, cert)
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.modified = modified
+	s.mu.Unlock()
+	log.Infof("Loaded %d TLS certificates", len(certs))
+	return nil
+}
+
+// changed reports whether any certificate file was modified since it was
+// last loaded.
+func (s *certStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for path, modified := range s.modified {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Likely in the middle of being replaced
+			continue
+		}
+		if !info.ModTime().Equal(modified) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates whenever their files change, checking every
+// interval.
+func (s *certStore) Watch(interval time.Duration) {
+	if len(s.pairs) == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Errorf("Could not reload TLS certificates, keeping the old ones: %s", err)
+			}
+		}
+	}()
+}
+
+// GetCertificate picks the first certificate valid for the name the client
+// asked for, or the first one if none is.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// parseCertificate loads a PEM certificate and key, keeping the parsed leaf
+// so that choosing between certificates does not parse them on every
+// handshake.
+func parseCertificate(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// selfSignedPEM generates a self-signed certificate for the given host names
+// and IP addresses.
+func selfSignedPEM(hosts []string, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gie-proxy"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// strictTransport adds a Strict-Transport-Security header to responses sent
+// over TLS, telling browsers to only use HTTPS for maxAge.
+func strictTransport(maxAge time.Duration, next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secureCookies marks the cookies set by a backend, which is spoken to over
+// plain HTTP, as Secure when the user is on HTTPS.
+func secureCookies(header http.Header) {
+	for i, value := range header["Set-Cookie"] {
+		secure := false
+		for _, attr := range strings.Split(value, ";")[1:] {
+			if strings.EqualFold(strings.TrimSpace(attr), "secure") {
+				secure = true
+			}
+		}
+		if !secure {
+			header["Set-Cookie"][i] = value + "; Secure"
+		}
+	}
+}
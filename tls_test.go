@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate generates a self-signed certificate for host into dir,
+// returning its files and adding it to roots.
+func writeCertificate(t *testing.T, dir, host string, roots *x509.CertPool) certPair {
+	certPEM, keyPEM, err := selfSignedPEM([]string{host}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := certPair{Cert: filepath.Join(dir, host+".pem"), Key: filepath.Join(dir, host+".key")}
+	if err := ioutil.WriteFile(pair.Cert, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.Key, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	roots.AppendCertsFromPEM(certPEM)
+	return pair
+}
+
+func TestFrontendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gie-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	roots := x509.NewCertPool()
+	pairs := []certPair{
+		writeCertificate(t, dir, "a.example.org", roots),
+		writeCertificate(t, dir, "b.example.org", roots),
+	}
+	certs, err := newCertStore(pairs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.Header.Get("X-Forwarded-Proto")})
+	}))
+	defer backend.Close()
+	rm := &RouteMapping{AuthCookieName: "sid"}
+	rm.AddRoute("test", Route{FrontendPath: "/app", BackendAddr: backend.Listener.Addr().String(), AuthorizedCookie: "user"})
+	f := &frontend{Path: "/gxproxy", TLS: certs, HSTS: time.Hour}
+	proxy := httptest.NewUnstartedServer(f.handler(rm))
+	proxy.TLS = f.tlsConfig()
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	fetch := func(name string) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: name, RootCAs: roots},
+		}}
+		res, err := client.Do(proxyRequest(proxy, "/gxproxy/app/"))
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+	for _, name := range []string{"a.example.org", "b.example.org"} {
+		res, err := fetch(name)
+		if err != nil {
+			t.Fatal("Wrong certificate for", name, err)
+		}
+		if res.Header.Get("Strict-Transport-Security") != "max-age=3600" {
+			t.Error("Missing HSTS header", res.Header)
+		}
+		if cookie := res.Header.Get("Set-Cookie"); cookie != "session=https; Secure" {
+			t.Error("Backend cookie was set as", cookie)
+		}
+	}
+
+	// A renewed certificate is picked up, a broken one is not
+	serial := certs.certs[0].Leaf.SerialNumber
+	writeCertificate(t, dir, "a.example.org", roots)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pairs[0].Cert, later, later)
+	if !certs.changed() {
+		t.Fatal("Renewed certificate went unnoticed")
+	}
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if certs.changed() || certs.certs[0].Leaf.SerialNumber.Cmp(serial) == 0 {
+		t.Error("Renewed certificate was not loaded")
+	}
+	if _, err := fetch("a.example.org"); err != nil {
+		t.Error("Renewed certificate was not served", err)
+	}
+
+	ioutil.WriteFile(pairs[1].Cert, []byte("garbage"), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Error("Broken certificate was loaded")
+	}
+	if _, err := fetch("b.example.org"); err != nil {
+		t.Error("Old certificate was dropped", err)
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	if _, err := loadCertificates([]string{"a.pem"}, nil, false); err == nil {
+		t.Error("A certificate without a key was accepted")
+	}
+	if _, err := newCertStore(nil, false); err == nil {
+		t.Error("No certificates were accepted")
+	}
+	certs, err := newCertStore(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil || cert.Leaf.VerifyHostname("localhost") != nil || cert.Leaf.VerifyHostname("127.0.0.1") != nil {
+		t.Error("Self-signed certificate is not for this machine", err)
+	}
+}
@@ -1,15 +1,41 @@
 package main
 
 import (
-	docker "github.com/fsouza/go-dockerclient"
+	"encoding/xml"
+	"html/template"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type frontend struct {
-	Addr   string
-	Path   string
-	APIKey string
+	Addr string
+	Path string
+	// AdminAddr, if set, is where the admin endpoints such as /metrics
+	// are served. Without, the health checks are served with the API.
+	AdminAddr string
+	// APIHost is the host name Galaxy reaches the API by, besides localhost
+	// and the address listened on. Host routes may not cover it.
+	APIHost string
+	APIKeys *apiKeyring
+	// AccessLog, if set, records every request to a route.
+	AccessLog *accessLog
+	// StartingPage is shown while a route's backend starts up, instead of
+	// the default one.
+	StartingPage *template.Template
+	// TLS, if set, serves the frontend over HTTPS with its certificates.
+	TLS *certStore
+	// HSTS is the max-age of the Strict-Transport-Security header sent
+	// over HTTPS. Zero sends none.
+	HSTS time.Duration
+
+	// listening is set while the frontend accepts connections. Only
+	// accessed atomically.
+	listening int32
+	// runtimeCheck holds the readinessCheck from the latest ping of the
+	// default runtime's daemon.
+	runtimeCheck atomic.Value
 }
 
 type requestHandler struct {
@@ -25,23 +51,138 @@ type apiHandler struct {
 }
 
 // Route represents connection information to wire up a frontend request to a
-// backend
+// backend. Once a route has been added to a RouteMapping its exported fields
+// are never modified in place; everything that changes while the route is
+// live is kept in its routeState.
 type Route struct {
-	FrontendPath     string
-	BackendAddr      string
+	// ID is assigned by the server when the route is added and is used to
+	// address it through the API.
+	ID string
+	// Host, if set, is the host name the route is served at, such as
+	// abc.gie.example.org, or a pattern like *.gie.example.org matching
+	// any subdomain. Such routes are served at the root of their host
+	// rather than under the frontend's path.
+	Host         string `xml:",omitempty" json:",omitempty"`
+	FrontendPath string
+	BackendAddr  string
+	// Backends lists several addresses serving the route, in place of
+	// BackendAddr. Either takes host:port, https://host:port or
+	// unix:///path/to.sock.
+	Backends []string `xml:"Backends>Backend,omitempty" json:",omitempty"`
+	// Balance is how requests are spread over Backends: round-robin (the
+	// default), least-conn or cookie-hash.
+	Balance string `xml:",omitempty" json:",omitempty"`
+	// BackendTLS is how https:// backends are verified.
+	BackendTLS       *BackendTLS `json:",omitempty"`
 	AuthorizedCookie string
 	LastSeen         time.Time
 	ContainerIds     []string `xml:"ContainerIds"`
+	// Runtime names the ContainerRuntime managing ContainerIds. Empty
+	// selects the RouteMapping's default.
+	Runtime string `xml:",omitempty" json:",omitempty"`
+	// Teardown overrides the RouteMapping's teardown policy.
+	Teardown *TeardownPolicy `json:",omitempty"`
+	// Rewrite changes the request path before it is sent to the backend.
+	// Without it the backend sees the full path the user requested.
+	Rewrite *RewritePolicy `json:",omitempty"`
+	// HealthPath is requested to find out whether a pending route's backend
+	// is up. Without one, a TCP connection to it is enough.
+	HealthPath string `xml:",omitempty" json:",omitempty"`
+	// State is pending or ready, maintained by the server.
+	State string `xml:",omitempty" json:",omitempty"`
+	live  *routeState
+}
+
+// routeState holds the mutable, concurrently accessed state of a live route.
+type routeState struct {
+	// Unix nanoseconds of the last access, only accessed atomically.
+	seen int64
+	// stored is the value of seen last written to the store, also only
+	// accessed atomically.
+	stored int64
+	// ready is 1 once the backend is up, only accessed atomically.
+	ready int32
+	// breaker tracks failures to reach the route's backends, whichever
+	// one requests were sent to.
+	breaker breakerState
+	// backends tracks each backend individually.
+	backends backendPool
+	metrics  routeMetrics
 }
 
 // RouteMapping represents essentially the server state, including all
-// routes and metadata necessary to re-launch in an identical state.
+// routes and metadata necessary to re-launch in an identical state. It is
+// safe for concurrent use.
 type RouteMapping struct {
-	Routes            []Route `xml:"Routes>Route"`
+	AuthCookieName string
+	// Storage is the URL of the route store, see parseStorageURL.
+	Storage string
+	// StorageBackups is how many previous versions of an XML Storage file
+	// are kept.
+	StorageBackups int
+	// Store persists the routes. If nil, InitializeRouteMapper opens
+	// Storage, and without either nothing is persisted.
+	Store             RouteStore
+	NoAccessThreshold time.Duration
+	DockerEndpoint    string
+	CleanInterval     time.Duration
+	// Runtimes are the available container runtimes, by name.
+	Runtimes map[string]ContainerRuntime
+	// DefaultRuntime is used for routes which don't name a runtime.
+	DefaultRuntime string
+	// Teardown is how containers of removed routes are shut down, unless
+	// the route has its own policy.
+	Teardown TeardownPolicy
+	// ProbeInterval is how often the backends of new routes are checked
+	// until they are up. Zero makes routes ready straight away.
+	ProbeInterval time.Duration
+	// StartupTimeout is how long a backend may take to come up before its
+	// route is removed. Zero waits forever.
+	StartupTimeout time.Duration
+	// Failures is how unreachable backends are dealt with.
+	Failures FailurePolicy
+	// Audit, if set, records every change to the routes.
+	Audit *auditLog
+
+	// mu guards routes and the indexes. The Route values themselves are immutable
+	// once added, so a pointer obtained under the lock stays valid to read.
+	mu     sync.RWMutex
+	routes []*Route
+	// index maps an authorized cookie to a radix tree of that user's
+	// routes, keyed by Route.indexKey.
+	index map[string]*radixTree
+	// byID maps route IDs to routes.
+	byID map[string]*Route
+	// hosts counts the routes of each Host pattern, whoever they belong to.
+	hosts map[string]int
+	// removals is a bounded history of removed routes, guarded by mu.
+	removals []*RouteRemoval
+	// teardowns tracks container teardowns running in the background.
+	teardowns sync.WaitGroup
+	// storeMu orders changes to the mapping with their writes to Store. It
+	// is taken before mu.
+	storeMu sync.Mutex
+	// restored is set once the routes were restored from storage. Only
+	// accessed atomically.
+	restored int32
+}
+
+// RouteRemoval records why and when a route was removed, and what went wrong
+// tearing down its containers.
+type RouteRemoval struct {
+	Route  Route
+	Reason string
+	Time   time.Time
+	Errors []string `json:",omitempty"`
+}
+
+// routeMappingFile is the on-disk (XML) representation of a RouteMapping.
+type routeMappingFile struct {
+	XMLName           xml.Name `xml:"RouteMapping"`
+	Routes            []Route  `xml:"Routes>Route"`
 	AuthCookieName    string
 	Storage           string
 	NoAccessThreshold time.Duration
 	DockerEndpoint    string
-	client            *docker.Client
 	CleanInterval     time.Duration
 }
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func shouldUpgradeWebsocket(r *http.Request) bool {
@@ -26,63 +28,107 @@ func shouldUpgradeWebsocket(r *http.Request) bool {
 	return upgradeWebsocket
 }
 
-func plumbWebsocket(w http.ResponseWriter, r *http.Request, route **Route) error {
+func plumbWebsocket(transport *http.Transport, w http.ResponseWriter, r *http.Request, route **Route) error {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
 		return errors.New("no-hijack")
 	}
-	conn, bufrw, err := hj.Hijack()
-	conn2, err := net.Dial("tcp", r.URL.Host)
+	// Connect first, so failing to can still be reported to the client
+	conn2, err := dialBackend(r.Context(), transport, r.URL)
 	if err != nil {
 		http.Error(w, "couldn't connect to backend server", http.StatusServiceUnavailable)
-		return errors.New("dead-backend")
+		return errDeadBackend
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		conn2.Close()
+		return err
 	}
 	err = r.Write(conn2)
 	if err != nil {
-		log.Warning("writing WebSocket request to backend server failed: %v", err)
-		return errors.New("dead-backend")
+		routeFields(*route).request(r).err(err).Warningf("Writing websocket request to backend server failed")
+		conn.Close()
+		conn2.Close()
+		return errDeadBackend
 	}
+	atomic.AddInt64(&metrics.websockets, 1)
+	defer atomic.AddInt64(&metrics.websockets, -1)
 	CopyBidir(conn, bufrw, conn2, bufio.NewReadWriter(bufio.NewReader(conn2), bufio.NewWriter(conn2)), route)
 	err = conn.Close()
 
 	if err != nil {
-		log.Warning("Could not close stream", err)
+		log.Warningf("Could not close stream: %s", err)
 	}
 	err = conn2.Close()
 	if err != nil {
-		log.Warning("Could not close stream", err)
+		log.Warningf("Could not close stream: %s", err)
 	}
 	return nil
 }
 
-func plumbHTTP(h *requestHandler, w http.ResponseWriter, r *http.Request, route **Route) error {
-	resp, err := h.Transport.RoundTrip(r)
-	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, "Error: %v", err)
-		return errors.New("dead-backend")
-	}
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			w.Header().Add(k, vv)
-		}
-	}
-	(*route).Seen()
-	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		log.Warning("Could not copy bytes", err)
+// proxyFlushInterval is how often buffered response data is flushed to the
+// client while it is streamed from the backend, so event streams and long
+// polls are not held back.
+const proxyFlushInterval = 100 * time.Millisecond
+
+// errDeadBackend is returned when the backend of a route could not be
+// reached at all.
+var errDeadBackend = errors.New("dead-backend")
+
+func plumbHTTP(h *requestHandler, transport *http.Transport, w http.ResponseWriter, r *http.Request, route **Route) error {
+	var proxyErr error
+	rw := h.newResponseRewriter(*route, r)
+	h.rewriteRequest(*route, r)
+	proxy := &httputil.ReverseProxy{
+		// The request was already pointed at the backend
+		Director:      func(*http.Request) {},
+		Transport:     transport,
+		FlushInterval: proxyFlushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			(*route).Seen()
+			resp.Body = &activityReader{ReadCloser: resp.Body, route: *route}
+			if rw != nil {
+				rw.rewrite(resp.Header)
+			}
+			if r.TLS != nil {
+				secureCookies(resp.Header)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() != nil {
+				// The client went away, that says nothing about the backend
+				routeFields(*route).request(r).err(err).Infof("Client gave up on %s", r.URL.Path)
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Error: %v", err)
+			proxyErr = errDeadBackend
+		},
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		log.Warning("Could not close response", err)
+	proxy.ServeHTTP(w, r)
+	return proxyErr
+}
+
+// activityReader marks a route as seen whenever data arrives from its
+// backend, so long running streams keep it alive, and counts that data.
+type activityReader struct {
+	io.ReadCloser
+	route *Route
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	if n > 0 {
+		a.route.Seen()
+		atomic.AddInt64(&a.route.live.metrics.sent, int64(n))
 	}
-	return nil
+	return n, err
 }
 
 // Copy from src buffer to destination buffer. One way.
-func Copy(dest *bufio.ReadWriter, src *bufio.ReadWriter, route **Route) {
+func Copy(dest *bufio.ReadWriter, src *bufio.ReadWriter, route **Route, counted *int64) {
 	buf := make([]byte, 40*1024)
 	for {
 		n, err := src.Read(buf)
@@ -94,14 +140,15 @@ func Copy(dest *bufio.ReadWriter, src *bufio.ReadWriter, route **Route) {
 			return
 		}
 		(*route).Seen()
+		atomic.AddInt64(counted, int64(n))
 		_, err = dest.Write(buf[0:n])
 		if err != nil && err != io.EOF {
-			log.Warning("Could not write to dest", err)
+			log.Warningf("Could not write to dest: %s", err)
 		}
 		err = dest.Flush()
 
 		if err != nil && err != io.EOF {
-			log.Warning("Could not flush to dest", err)
+			log.Warningf("Could not flush to dest: %s", err)
 		}
 	}
 }
@@ -110,12 +157,12 @@ func Copy(dest *bufio.ReadWriter, src *bufio.ReadWriter, route **Route) {
 func CopyBidir(conn1 io.ReadWriteCloser, rw1 *bufio.ReadWriter, conn2 io.ReadWriteCloser, rw2 *bufio.ReadWriter, route **Route) {
 	finished := make(chan bool)
 	go func() {
-		Copy(rw2, rw1, route)
+		Copy(rw2, rw1, route, &(*route).live.metrics.received)
 		_ = conn2.Close()
 		finished <- true
 	}()
 	go func() {
-		Copy(rw1, rw2, route)
+		Copy(rw1, rw2, route, &(*route).live.metrics.sent)
 		_ = conn1.Close()
 		finished <- true
 	}()